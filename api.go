@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// 設定ファイルと同じディレクトリに置く操作用のソケット
+const socketName = "local-runner-controller.sock"
+
+type PoolStatus struct {
+	Name       string            `json:"name"`
+	Limit      int               `json:"limit"`
+	Paused     bool              `json:"paused"`
+	Degraded   bool              `json:"degraded"`
+	Failures   int               `json:"failures"`
+	LastError  string            `json:"last_error,omitempty"`
+	Image      string            `json:"image"`
+	Built      bool              `json:"built"`
+	RateLimit  *RateLimitStatus  `json:"rate_limit,omitempty"`
+	Containers []ContainerStatus `json:"containers"`
+}
+
+type ContainerStatus struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	State  string `json:"state"`
+	Status string `json:"status"`
+}
+
+type LimitRequest struct {
+	Limit *int `json:"limit"`
+}
+
+type DrainRequest struct {
+	Pool string `json:"pool"`
+}
+
+func socketPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), socketName)
+}
+
+func (config *Config) poolStatuses() ([]PoolStatus, error) {
+	statuses := []PoolStatus{}
+	for _, pool := range config.poolList() {
+		build, err := config.hasToBuild(config.poolImageName(pool))
+		if err != nil {
+			return nil, err
+		}
+		list, err := config.Cli.ContainerList(config.Ctx, container.ListOptions{All: true, Filters: filters.NewArgs(filters.KeyValuePair{Key: "label", Value: poolLabel + "=" + pool.Name})})
+		if err != nil {
+			return nil, fmt.Errorf("Can not get containers list %s", err)
+		}
+		containers := []ContainerStatus{}
+		for _, c := range list {
+			containers = append(containers, ContainerStatus{Id: c.ID, Name: strings.TrimPrefix(strings.Join(c.Names, ","), "/"), State: c.State, Status: c.Status})
+		}
+		config.mu.Lock()
+		api := config.apiBase(pool)
+		status := PoolStatus{Name: pool.Name, Limit: pool.Limit, Paused: pool.Paused, Degraded: pool.degraded(), Failures: pool.Failures, LastError: pool.LastError, Image: config.poolImageName(pool), Built: !build, RateLimit: rateLimits.get(api).status(api), Containers: containers}
+		config.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (config *Config) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /pools", func(w http.ResponseWriter, r *http.Request) {
+		statuses, err := config.poolStatuses()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJson(w, http.StatusOK, statuses)
+	})
+	mux.HandleFunc("GET /containers", func(w http.ResponseWriter, r *http.Request) {
+		statuses, err := config.poolStatuses()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		containers := []ContainerStatus{}
+		for _, s := range statuses {
+			containers = append(containers, s.Containers...)
+		}
+		writeJson(w, http.StatusOK, containers)
+	})
+	mux.HandleFunc("GET /history", func(w http.ResponseWriter, r *http.Request) {
+		if config.History == nil || config.History.db == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("history is not enabled"))
+			return
+		}
+		since, err := time.Parse(time.RFC3339, r.URL.Query().Get("since"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("since must be RFC 3339"))
+			return
+		}
+		records, err := config.History.list(since)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJson(w, http.StatusOK, records)
+	})
+	mux.HandleFunc("PUT /pools/{name}/limit", func(w http.ResponseWriter, r *http.Request) {
+		pool := config.findPool(r.PathValue("name"))
+		if pool == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("Can not find pool %s", r.PathValue("name")))
+			return
+		}
+		var req LimitRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Limit == nil || *req.Limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be a non-negative number"))
+			return
+		}
+		config.mu.Lock()
+		pool.Limit = *req.Limit
+		ee := config.handlePool(pool)
+		config.mu.Unlock()
+		if ee != nil {
+			writeError(w, http.StatusInternalServerError, *ee)
+			return
+		}
+		config.rollMu.Lock()
+		err := config.trimPool(pool)
+		config.rollMu.Unlock()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Println("Set limit of", pool.Name, "to", *req.Limit)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /pools/{name}/pause", func(w http.ResponseWriter, r *http.Request) {
+		config.setPaused(w, r.PathValue("name"), true)
+	})
+	mux.HandleFunc("POST /pools/{name}/resume", func(w http.ResponseWriter, r *http.Request) {
+		config.setPaused(w, r.PathValue("name"), false)
+	})
+	mux.HandleFunc("POST /build", func(w http.ResponseWriter, r *http.Request) {
+		config.rollMu.Lock()
+		defer config.rollMu.Unlock()
+		if err := config.buildImages(true); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		// 同じタグで作り直したイメージに入れ替える
+		for _, pool := range config.poolList() {
+			if err := config.rollPool(pool); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /drain", func(w http.ResponseWriter, r *http.Request) {
+		var req DrainRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if req.Pool != "" && config.findPool(req.Pool) == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("Can not find pool %s", req.Pool))
+			return
+		}
+		// 止めたコンテナが作り直されないように先に一時停止する
+		config.mu.Lock()
+		for _, pool := range config.Pools {
+			if req.Pool == "" || pool.Name == req.Pool {
+				pool.Paused = true
+			}
+		}
+		config.mu.Unlock()
+		if err := config.drain(req.Pool); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+func (config *Config) setPaused(w http.ResponseWriter, name string, paused bool) {
+	pool := config.findPool(name)
+	if pool == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Can not find pool %s", name))
+		return
+	}
+	config.mu.Lock()
+	pool.Paused = paused
+	var ee *error
+	if !paused {
+		ee = config.handlePool(pool)
+	}
+	config.mu.Unlock()
+	if ee != nil {
+		writeError(w, http.StatusInternalServerError, *ee)
+		return
+	}
+	log.Println("Pool", name, "paused:", paused)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJson(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Println("Can not write response", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
+
+// ソケットでAPIを公開する。止める時はServerをCloseしてソケットを削除する
+func (config *Config) serveApi(socket string) (*http.Server, error) {
+	if _, err := os.Stat(socket); err == nil {
+		if socketAlive(socket) {
+			return nil, fmt.Errorf("another controller is listening on %s", socket)
+		}
+		// 前回異常終了した時のソケットが残っている
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("Can not listen %s %s", socket, err)
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	server := &http.Server{Handler: config.apiHandler()}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("API server stopped", err)
+		}
+	}()
+	log.Println("Listening on", socket)
+	return server, nil
+}
+
+func socketAlive(socket string) bool {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// 動いているコントローラーのAPIを呼ぶクライアント
+type ApiClient struct {
+	Client *http.Client
+}
+
+func newApiClient(socket string) *ApiClient {
+	return &ApiClient{Client: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}}
+}
+
+func (c *ApiClient) do(method, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, "http://local-runner-controller"+path, reader)
+	if err != nil {
+		return err
+	}
+	res, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&e)
+		return fmt.Errorf("%s %s status: %d %s", method, path, res.StatusCode, e.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSocketPath(t *testing.T) {
+	actual := socketPath("/etc/local-runner/config.json")
+	if actual != "/etc/local-runner/local-runner-controller.sock" {
+		t.Errorf("socketPath() = \n%v", actual)
+	}
+}
+
+func TestApiHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{
+			name:   "pause",
+			method: http.MethodPost,
+			path:   "/pools/go/pause",
+			want:   http.StatusNoContent,
+		},
+		{
+			name:   "pause unknown pool",
+			method: http.MethodPost,
+			path:   "/pools/node/pause",
+			want:   http.StatusNotFound,
+		},
+		{
+			name:   "limit without body",
+			method: http.MethodPut,
+			path:   "/pools/go/limit",
+			body:   `{}`,
+			want:   http.StatusBadRequest,
+		},
+		{
+			name:   "negative limit",
+			method: http.MethodPut,
+			path:   "/pools/go/limit",
+			body:   `{"limit": -1}`,
+			want:   http.StatusBadRequest,
+		},
+		{
+			name:   "drain unknown pool",
+			method: http.MethodPost,
+			path:   "/drain",
+			body:   `{"pool": "node"}`,
+			want:   http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			config := &Config{Pools: []*Pool{{Name: "go", Limit: 1}}}
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			res := httptest.NewRecorder()
+
+			config.apiHandler().ServeHTTP(res, req)
+
+			if res.Code != tt.want {
+				t.Errorf("%s %s status = \n%v, want \n%v %s", tt.method, tt.path, res.Code, tt.want, res.Body.String())
+			}
+		})
+	}
+}
+
+func TestServeApi(t *testing.T) {
+	config := &Config{Pools: []*Pool{{Name: "go", Limit: 1}}}
+	socket := filepath.Join(t.TempDir(), socketName)
+	server, err := config.serveApi(socket)
+	if err != nil {
+		t.Fatalf("serveApi() error = %v", err)
+	}
+	defer server.Close()
+
+	if _, err := config.serveApi(socket); err == nil {
+		t.Errorf("serveApi() on a used socket error = nil")
+	}
+
+	api := newApiClient(socket)
+	if err := api.do(http.MethodPost, "/pools/go/pause", nil, nil); err != nil {
+		t.Fatalf("pause error = %v", err)
+	}
+	if !config.Pools[0].Paused {
+		t.Errorf("pool go is not paused")
+	}
+	err = api.do(http.MethodPost, "/pools/node/pause", nil, nil)
+	assert(t, "pause unknown pool error", err, fmt.Errorf("POST /pools/node/pause status: 404 Can not find pool node"))
+}
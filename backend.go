@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"log"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// ランナーを登録する先ごとの処理
+type Backend interface {
+	// プールのイメージに追加する命令とファイル。ベースイメージのままでよければ空
+	dockerfile(config *Config) string
+	addTo(config *Config, tw *tar.Writer) error
+	// コンテナ名。ランナー名にもなる
+	runnerName(pool *Pool) string
+	// コンテナに渡す環境変数とマウント。登録に必要なトークンもここで用意する
+	containerSpec(config *Config, pool *Pool, name string) (*ContainerSpec, error)
+	// ランナーの登録を解除してコンテナを終了させる
+	stop(config *Config, c types.Container) error
+	// コンテナが終了した後の後始末。labelsはコンテナのラベル
+	exited(config *Config, name string, labels map[string]string) error
+	// オフラインのまま残ったランナーの登録を削除する
+	cleanup(config *Config) error
+}
+
+type ContainerSpec struct {
+	Env    []string
+	Binds  []string
+	Labels map[string]string
+}
+
+// コンテナを作ったバックエンドを付けるラベル
+const backendLabel = "local-runner.backend"
+
+const gitHubBackend = "github"
+
+var backends = map[string]Backend{
+	gitHubBackend:  &GitHubBackend{},
+	forgejoBackend: &ForgejoBackend{},
+	gitLabBackend:  &GitLabBackend{},
+}
+
+func (config *Config) backend(pool *Pool) Backend {
+	return backendOf(pool.backendName())
+}
+
+func backendOf(name string) Backend {
+	if b, ok := backends[name]; ok {
+		return b
+	}
+	return backends[gitHubBackend]
+}
+
+func (pool *Pool) backendName() string {
+	if pool.Backend == "" {
+		return gitHubBackend
+	}
+	return pool.Backend
+}
+
+// 使われているバックエンド
+func (config *Config) usedBackends() []Backend {
+	pools := config.poolList()
+	used := []Backend{}
+	for _, name := range []string{gitHubBackend, forgejoBackend, gitLabBackend} {
+		if slices.ContainsFunc(pools, func(p *Pool) bool { return p.backendName() == name }) {
+			used = append(used, backends[name])
+		}
+	}
+	return used
+}
+
+func randomRunnerName(pool *Pool) string {
+	seed := time.Now().UnixNano()
+	rand.New(rand.NewSource(seed))
+	val := rand.Intn(100000)
+	return runnerNamePrefix + pool.Name + "-" + strconv.Itoa(val)
+}
+
+// ランナーを登録した時にコンテナに付けるID
+const runnerIdLabel = "local-runner.runner-id"
+
+// ラベルを付ける前のコンテナも登録を解除できるようにランナー名とIDを覚えておく
+type Registrations struct {
+	mu  sync.Mutex
+	ids map[string]int
+}
+
+func (r *Registrations) add(name string, id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ids == nil {
+		r.ids = map[string]int{}
+	}
+	r.ids[name] = id
+}
+
+// コンテナのラベルか、なければ登録した時に覚えたIDを取り出す
+func (r *Registrations) take(name string, labels map[string]string, label string) (int, bool) {
+	r.mu.Lock()
+	id, ok := r.ids[name]
+	delete(r.ids, name)
+	r.mu.Unlock()
+	if v, err := strconv.Atoi(labels[label]); err == nil {
+		return v, true
+	}
+	return id, ok
+}
+
+// GitHub Actionsのランナー。コントローラーがJIT設定で登録する
+type GitHubBackend struct {
+	registrations Registrations
+}
+
+func (b *GitHubBackend) dockerfile(config *Config) string {
+	return ""
+}
+
+func (b *GitHubBackend) addTo(config *Config, tw *tar.Writer) error {
+	return nil
+}
+
+func (b *GitHubBackend) runnerName(pool *Pool) string {
+	return randomRunnerName(pool)
+}
+
+// コンテナにはJIT設定だけを渡す。PATや秘密鍵はコンテナに入れない
+func (b *GitHubBackend) containerSpec(config *Config, pool *Pool, name string) (*ContainerSpec, error) {
+	runner := config.Runner
+	groupId := config.runnerGroupId
+	if groupId == 0 {
+		groupId = defaultRunnerGroupId
+	}
+	jit, err := config.gitHub().forPool().generateJitConfig(runner.scopePath(), name, groupId, config.jitLabels(pool))
+	if err != nil {
+		return nil, fmt.Errorf("Can not generate jit config %s", err)
+	}
+	b.registrations.add(name, jit.Runner.Id)
+
+	spec := &ContainerSpec{
+		Env:    []string{"JIT_CONFIG=" + jit.EncodedJitConfig, "RUNNER_ALLOW_RUNASROOT=abc"},
+		Labels: map[string]string{runnerIdLabel: strconv.Itoa(jit.Runner.Id)},
+	}
+	// ジョブの履歴を残す場合は開始時にジョブの情報を書き出させる
+	if config.History != nil {
+		env, binds, err := config.History.hookSpec()
+		if err != nil {
+			return nil, err
+		}
+		spec.Env = append(spec.Env, env...)
+		spec.Binds = append(spec.Binds, binds...)
+	}
+	if runner.Enterprise != "" {
+		spec.Labels["enterprise"] = runner.Enterprise
+	} else {
+		spec.Labels["owner"] = runner.Owner
+	}
+	if runner.Repository != "" {
+		spec.Labels["repository"] = runner.Repository
+	}
+	return spec, nil
+}
+
+// config.shが付けるデフォルトのラベルはJIT設定では自分で付ける
+func (config *Config) jitLabels(pool *Pool) []string {
+	arch := map[string]string{"amd64": "X64", "arm64": "ARM64", "arm": "ARM"}[config.targetArch()]
+	return append([]string{"self-hosted", "Linux", arch}, config.poolLabels(pool)...)
+}
+
+// 登録を解除してからコンテナを止める。ジョブを実行中のランナーは解除できないのでそのままにする
+func (b *GitHubBackend) stop(config *Config, c types.Container) error {
+	if id, err := strconv.Atoi(c.Labels[runnerIdLabel]); err == nil {
+		if err := config.gitHub().deleteRunner(config.Runner.scopePath(), id); err != nil && !isNotFound(err) {
+			return fmt.Errorf("Can not remove runner %s %s", c.Names, err)
+		}
+	}
+	return config.Cli.ContainerStop(config.Ctx, c.ID, container.StopOptions{})
+}
+
+// ジョブを実行せずに終了したランナーの登録を削除する。ジョブを実行したランナーはGitHubが削除する
+func (b *GitHubBackend) exited(config *Config, name string, labels map[string]string) error {
+	id, ok := b.registrations.take(name, labels, runnerIdLabel)
+	if !ok {
+		return nil
+	}
+	if err := config.gitHub().forPool().deleteRunner(config.Runner.scopePath(), id); err != nil && !isNotFound(err) {
+		return fmt.Errorf("Can not remove runner %s %s", name, err)
+	}
+	return nil
+}
+
+func (b *GitHubBackend) cleanup(config *Config) error {
+	gh := config.gitHub()
+	scope := config.Runner.scopePath()
+	runners, err := gh.listRunners(scope)
+	if err != nil {
+		return fmt.Errorf("Can not get runners %s", err)
+	}
+	removeOfflineRunners(runners, func(r GitHubRunner) error {
+		return gh.deleteRunner(scope, r.Id)
+	})
+	return nil
+}
+
+func removeOfflineRunners(runners []GitHubRunner, remove func(GitHubRunner) error) {
+	for _, r := range runners {
+		if r.Status != "offline" || !strings.HasPrefix(r.Name, runnerNamePrefix) {
+			continue
+		}
+		log.Println("Remove runner", r.Name)
+		if err := remove(r); err != nil {
+			log.Println("Can not remove runner", r.Name, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestJitLabels(t *testing.T) {
+	tests := []struct {
+		name  string
+		param *Config
+		want  []string
+	}{
+		{
+			name:  "amd64",
+			param: &Config{Arch: "amd64", Labels: []string{"linux"}},
+			want:  []string{"self-hosted", "Linux", "X64", "linux", "gpu"},
+		},
+		{
+			name:  "arm64",
+			param: &Config{Arch: "arm64"},
+			want:  []string{"self-hosted", "Linux", "ARM64", "gpu"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := tt.param.jitLabels(&Pool{Name: "gpu", Labels: []string{"gpu"}})
+
+			if !slices.Equal(actual, tt.want) {
+				t.Errorf("jitLabels() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitHubBackendJitConfig(t *testing.T) {
+	requests := []map[string]any{}
+	deleted := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /orgs/owner/actions/runners/generate-jitconfig":
+			var body map[string]any
+			json.NewDecoder(r.Body).Decode(&body)
+			requests = append(requests, body)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"runner": {"id": 23, "name": "%s"}, "encoded_jit_config": "encoded"}`, body["name"])
+		case "DELETE /orgs/owner/actions/runners/23":
+			deleted = append(deleted, "23")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	config := &Config{
+		Runner:        &Runner{ApiDomain: server.URL, Domain: "github.com", Owner: "owner", Auth: &Auth{AccessToken: "token"}},
+		Arch:          "amd64",
+		HttpClient:    server.Client(),
+		runnerGroupId: 4,
+	}
+	backend := &GitHubBackend{}
+
+	spec, err := backend.containerSpec(config, &Pool{Name: "default"}, "local-runner-default-1")
+	assert(t, "containerSpec() error", err, nil)
+	if err != nil {
+		return
+	}
+	want := map[string]any{"name": "local-runner-default-1", "runner_group_id": float64(4), "labels": []any{"self-hosted", "Linux", "X64"}, "work_folder": "_work"}
+	if len(requests) != 1 || fmt.Sprint(requests[0]) != fmt.Sprint(want) {
+		t.Errorf("containerSpec() request = \n%v, want \n%v", requests, want)
+	}
+	if !slices.Equal(spec.Env, []string{"JIT_CONFIG=encoded", "RUNNER_ALLOW_RUNASROOT=abc"}) {
+		t.Errorf("containerSpec() env = \n%v", spec.Env)
+	}
+	if spec.Labels[runnerIdLabel] != "23" || spec.Labels["owner"] != "owner" {
+		t.Errorf("containerSpec() labels = \n%v", spec.Labels)
+	}
+
+	// ラベルがなくても登録した時のIDで削除し、既に削除されていれば何もしない
+	assert(t, "exited() error", backend.exited(config, "local-runner-default-1", map[string]string{}), nil)
+	assert(t, "exited() error", backend.exited(config, "local-runner-default-2", map[string]string{runnerIdLabel: "24"}), nil)
+	assert(t, "exited() error", backend.exited(config, "local-runner-default-3", map[string]string{}), nil)
+	if !slices.Equal(deleted, []string{"23"}) {
+		t.Errorf("exited() deleted = \n%v, want \n%v", deleted, []string{"23"})
+	}
+}
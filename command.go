@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"gopkg.in/yaml.v3"
+)
+
+const configPathEnv = "LOCAL_RUNNER_CONTROLLER_CONFIG_PATH"
+
+const usage = `Usage: local-runner-controller <command> [-config path] [args]
+
+Commands:
+  run               Start the controller (default)
+  status            List pools and their containers
+  build             Build the runner images even if they exist
+  scale <pool> <n>  Change the number of runners of a pool
+  drain [pool]      Unregister runners and stop their containers
+  pause <pool>      Stop creating runners of a pool in the running controller
+  resume <pool>     Resume a paused pool in the running controller
+  cleanup           Remove leftover containers, images and GitHub registrations
+  history [-since d] List jobs run on the runners (default: the last 24h)
+  report [-since d]  Summarise resource usage of jobs by repository and workflow (default: the last 7 days)
+  validate          Check the config file without touching Docker
+  schema            Print the JSON Schema of the config file
+`
+
+func defaultConfigPath() string {
+	if p := os.Getenv(configPathEnv); p != "" {
+		return p
+	}
+	return "config.json"
+}
+
+func runCommand(cmd string, args []string) error {
+	switch cmd {
+	case "schema":
+		data, err := configSchemaJson()
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	case "run", "status", "build", "scale", "drain", "cleanup", "pause", "resume", "validate", "history", "report":
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %s", cmd)
+	}
+
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	path := fs.String("config", defaultConfigPath(), "path of config file")
+	switch cmd {
+	case "history":
+		fs.Duration("since", 24*time.Hour, "list jobs finished within this duration")
+	case "report":
+		fs.Duration("since", 7*24*time.Hour, "summarise jobs finished within this duration")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if cmd == "validate" {
+		return validateConfig(os.Stdout, *path)
+	}
+
+	// コントローラーが動いていればAPI経由で操作する
+	socket := socketPath(*path)
+	if socketAlive(socket) {
+		switch cmd {
+		case "run":
+		case "cleanup":
+			// 待機中のコンテナや記録する前の終了したコンテナを消してしまうので動いている間はしない
+			return fmt.Errorf("controller is running (%s), stop it before cleanup", socket)
+		default:
+			return runRemoteCommand(newApiClient(socket), cmd, *path, fs)
+		}
+	}
+	if cmd == "pause" || cmd == "resume" {
+		return fmt.Errorf("controller is not running (%s)", socket)
+	}
+
+	config, err := loadConfig(*path)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "status":
+		statuses, err := config.poolStatuses()
+		if err != nil {
+			return err
+		}
+		return printStatus(os.Stdout, statuses)
+	case "build":
+		return config.buildImages(true)
+	case "scale":
+		name, n, err := scaleArgs(fs)
+		if err != nil {
+			return err
+		}
+		return config.scale(*path, name, n)
+	case "drain":
+		return config.drain(fs.Arg(0))
+	case "cleanup":
+		return config.cleanup()
+	case "history", "report":
+		if config.History == nil {
+			return fmt.Errorf("history is not enabled in %s", *path)
+		}
+		if err := config.History.open(true); err != nil {
+			return err
+		}
+		defer config.History.close()
+		records, err := config.History.list(historySince(fs))
+		if err != nil {
+			return err
+		}
+		return printJobs(os.Stdout, cmd, records)
+	}
+	return config.run()
+}
+
+func runRemoteCommand(api *ApiClient, cmd, path string, fs *flag.FlagSet) error {
+	switch cmd {
+	case "status":
+		var statuses []PoolStatus
+		if err := api.do(http.MethodGet, "/pools", nil, &statuses); err != nil {
+			return err
+		}
+		return printStatus(os.Stdout, statuses)
+	case "build":
+		return api.do(http.MethodPost, "/build", nil, nil)
+	case "scale":
+		name, n, err := scaleArgs(fs)
+		if err != nil {
+			return err
+		}
+		if err := writePoolLimit(path, name, n); err != nil {
+			return err
+		}
+		return api.do(http.MethodPut, "/pools/"+url.PathEscape(name)+"/limit", LimitRequest{Limit: &n}, nil)
+	case "drain":
+		return api.do(http.MethodPost, "/drain", DrainRequest{Pool: fs.Arg(0)}, nil)
+	case "history", "report":
+		var records []JobRecord
+		if err := api.do(http.MethodGet, "/history?since="+url.QueryEscape(historySince(fs).Format(time.RFC3339)), nil, &records); err != nil {
+			return err
+		}
+		return printJobs(os.Stdout, cmd, records)
+	case "pause", "resume":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: %s <pool>", cmd)
+		}
+		return api.do(http.MethodPost, "/pools/"+url.PathEscape(fs.Arg(0))+"/"+cmd, nil, nil)
+	}
+	return fmt.Errorf("unknown command %s", cmd)
+}
+
+func loadConfig(path string) (*Config, error) {
+	bytes, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := makeConfig(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid enviroment variables: %s", configFileError(path, err))
+	}
+	config.ConfigPath = path
+	return config, nil
+}
+
+func validateConfig(w io.Writer, path string) error {
+	data, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	config, err := parseConfig(data)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, configFileError(path, err))
+	}
+	fmt.Fprintln(w, path, "is valid")
+	for _, pool := range config.Pools {
+		fmt.Fprintf(w, "  pool %s limit: %d image: %s\n", pool.Name, pool.Limit, config.poolImageName(pool))
+	}
+	return nil
+}
+
+func printStatus(w io.Writer, statuses []PoolStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "POOL\tLIMIT\tPAUSED\tDEGRADED\tFAILURES\tIMAGE\tBUILT")
+	for _, s := range statuses {
+		fmt.Fprintf(tw, "%s\t%d\t%t\t%t\t%d\t%s\t%t\n", s.Name, s.Limit, s.Paused, s.Degraded, s.Failures, s.Image, s.Built)
+	}
+	// プールが同じAPIを使う場合は1行にまとめる
+	apis := map[string]bool{}
+	for _, s := range statuses {
+		if s.RateLimit == nil || apis[s.RateLimit.Api] {
+			continue
+		}
+		if len(apis) == 0 {
+			fmt.Fprintln(tw)
+			fmt.Fprintln(tw, "API\tREMAINING\tLIMIT\tRESET")
+		}
+		apis[s.RateLimit.Api] = true
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", s.RateLimit.Api, s.RateLimit.Remaining, s.RateLimit.Limit, s.RateLimit.Reset.Local().Format(time.TimeOnly))
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "CONTAINER\tNAME\tPOOL\tSTATE\tSTATUS")
+	for _, s := range statuses {
+		for _, c := range s.Containers {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", c.Id[:12], c.Name, s.Name, c.State, c.Status)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		if s.Degraded {
+			fmt.Fprintf(w, "\nPool %s is degraded. Last error: %s\n", s.Name, s.LastError)
+		}
+	}
+	return nil
+}
+
+func printJobs(w io.Writer, cmd string, records []JobRecord) error {
+	if cmd == "report" {
+		return printUsageReport(w, makeUsageReport(records))
+	}
+	return printHistory(w, records)
+}
+
+func historySince(fs *flag.FlagSet) time.Time {
+	return time.Now().Add(-fs.Lookup("since").Value.(flag.Getter).Get().(time.Duration))
+}
+
+func scaleArgs(fs *flag.FlagSet) (string, int, error) {
+	if fs.NArg() != 2 {
+		return "", 0, fmt.Errorf("usage: scale <pool> <n>")
+	}
+	n, err := strconv.Atoi(fs.Arg(1))
+	if err != nil || n < 0 {
+		return "", 0, fmt.Errorf("invalid number of runners %s", fs.Arg(1))
+	}
+	return fs.Arg(0), n, nil
+}
+
+// 設定ファイルのプールの上限を書き換えてコンテナ数を合わせる
+func (config *Config) scale(path, name string, n int) error {
+	pool := config.findPool(name)
+	if pool == nil {
+		return fmt.Errorf("Can not find pool %s", name)
+	}
+	if err := writePoolLimit(path, name, n); err != nil {
+		return err
+	}
+
+	pool.Limit = n
+	if ee := config.handlePool(pool); ee != nil {
+		return *ee
+	}
+	return config.trimPool(pool)
+}
+
+// 上限を超えたコンテナを停止する
+func (config *Config) trimPool(pool *Pool) error {
+	containers, err := config.listContainers(pool)
+	if err != nil {
+		return fmt.Errorf("Can not get containers list %s", err)
+	}
+	if len(containers) <= pool.Limit {
+		return nil
+	}
+	config.stopContainers(containers[pool.Limit:])
+	return nil
+}
+
+func writePoolLimit(path, name string, n int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	updated, err := setPoolLimit(path, data, name, n)
+	if err != nil {
+		return err
+	}
+	// 環境変数で上書きされていると書き換えても反映されない
+	if env := envName([]string{"limit"}); name == defaultPoolName && os.Getenv(env) != "" {
+		return fmt.Errorf("%s overrides the limit in %s, change it instead", env, path)
+	}
+	if err := os.WriteFile(path, updated, 0644); err != nil {
+		return err
+	}
+	log.Println("Set limit of", name, "to", n, "in", path)
+	return nil
+}
+
+// 設定ファイルのプールの上限だけを書き換える。他の項目の順番や書式はそのまま残す
+func setPoolLimit(path string, data []byte, name string, n int) ([]byte, error) {
+	env, err := decodeConfigFile(path, data)
+	if err != nil {
+		return nil, err
+	}
+	// プールがなければデフォルトのプールの上限は一番上のlimit
+	index := -1
+	if pools, ok := env["pools"].([]any); ok && len(pools) > 0 {
+		for i, p := range pools {
+			if pool, ok := p.(map[string]any); ok && pool["name"] == name {
+				index = i
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("Can not find pool %s", name)
+		}
+	} else if name != defaultPoolName {
+		return nil, fmt.Errorf("Can not find pool %s", name)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return setYamlPoolLimit(data, index, n)
+	case ".toml":
+		return nil, fmt.Errorf("scale can not rewrite TOML config files, change the limit of %s in %s", name, path)
+	}
+	return setJsonPoolLimit(data, index, n)
+}
+
+func setYamlPoolLimit(data []byte, index, n int) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("Config file is invalid %v", err)
+	}
+	target := doc.Content[0]
+	if index >= 0 {
+		target = yamlValue(target, "pools").Content[index]
+	}
+	value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(n)}
+	if v := yamlValue(target, "limit"); v != nil {
+		// 行末のコメントは残す
+		v.Kind, v.Tag, v.Value, v.Style, v.Content = value.Kind, value.Tag, value.Value, 0, nil
+	} else {
+		target.Content = append(target.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "limit"}, value)
+	}
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func yamlValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// JSONのlimitの値の位置を探して置き換える。なければオブジェクトの先頭に追加する
+func setJsonPoolLimit(data []byte, index, n int) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	if index >= 0 {
+		found, err := seekJsonKey(dec, "pools")
+		if err != nil || !found {
+			return nil, fmt.Errorf("Config file is invalid %v", err)
+		}
+		if err := expectDelim(dec, '['); err != nil {
+			return nil, err
+		}
+		for i := 0; i < index; i++ {
+			if err := skipJsonValue(dec); err != nil {
+				return nil, err
+			}
+		}
+		if err := expectDelim(dec, '{'); err != nil {
+			return nil, err
+		}
+	}
+	open := int(dec.InputOffset())
+	empty := !dec.More()
+	found, err := seekJsonKey(dec, "limit")
+	if err != nil {
+		return nil, err
+	}
+	value := strconv.Itoa(n)
+	if !found {
+		if empty {
+			return slices.Concat(data[:open], []byte(`"limit": `+value), data[open:]), nil
+		}
+		// 最初のキーと同じ字下げで追加する
+		first := open + len(data[open:]) - len(bytes.TrimLeft(data[open:], " \t\r\n"))
+		return slices.Concat(data[:first], []byte(`"limit": `+value+","), data[open:first], data[first:]), nil
+	}
+	start := int(dec.InputOffset())
+	start += len(data[start:]) - len(bytes.TrimLeft(data[start:], " \t\r\n:"))
+	if err := skipJsonValue(dec); err != nil {
+		return nil, err
+	}
+	return slices.Concat(data[:start], []byte(value), data[dec.InputOffset():]), nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("Config file is invalid %s", err)
+	}
+	if tok != delim {
+		return fmt.Errorf("Config file is invalid expected %s", delim)
+	}
+	return nil
+}
+
+// オブジェクトのキーを読み進めて、見つかったら値の手前で止まる
+func seekJsonKey(dec *json.Decoder, key string) (bool, error) {
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return false, fmt.Errorf("Config file is invalid %s", err)
+		}
+		if tok == key {
+			return true, nil
+		}
+		if err := skipJsonValue(dec); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func skipJsonValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("Config file is invalid %s", err)
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// ランナーの登録を解除してコンテナを止める。プール名がなければ全てのプール
+func (config *Config) drain(name string) error {
+	pools := config.poolList()
+	if name != "" {
+		pool := config.findPool(name)
+		if pool == nil {
+			return fmt.Errorf("Can not find pool %s", name)
+		}
+		pools = []*Pool{pool}
+	}
+	for _, pool := range pools {
+		containers, err := config.listContainers(pool)
+		if err != nil {
+			return fmt.Errorf("Can not get containers list %s", err)
+		}
+		config.stopContainers(containers)
+	}
+	return nil
+}
+
+// タグを除いたイメージ名。レジストリのポートの":"はタグではない
+func imageRepository(name string) string {
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		return name[:i]
+	}
+	return name
+}
+
+// 残ったコンテナ、使われていないイメージ、オフラインのランナー登録を削除する
+func (config *Config) cleanup() error {
+	list, err := config.Cli.ContainerList(config.Ctx, container.ListOptions{All: true, Filters: filters.NewArgs(filters.KeyValuePair{Key: "label", Value: poolLabel})})
+	if err != nil {
+		return fmt.Errorf("Can not get containers list %s", err)
+	}
+	for _, c := range list {
+		// 登録の設定を待っているコンテナは登録がないので消してよい
+		if c.State == "running" && !warmIdle(c) {
+			continue
+		}
+		log.Println("Remove container", c.ID)
+		if err := config.Cli.ContainerRemove(config.Ctx, c.ID, container.RemoveOptions{Force: true}); err != nil {
+			log.Println("Can not remove container", c.ID, err)
+		}
+	}
+
+	current := map[string]bool{config.imageName(): true}
+	for _, pool := range config.Pools {
+		current[config.poolImageName(pool)] = true
+		if config.Snapshot == nil {
+			continue
+		}
+		if name, err := config.snapshotName(pool); err == nil {
+			current[name] = true
+		}
+	}
+	repository := imageRepository(config.imageName())
+	images, err := config.Cli.ImageList(config.Ctx, image.ListOptions{Filters: filters.NewArgs(filters.KeyValuePair{Key: "reference", Value: repository})})
+	if err != nil {
+		return fmt.Errorf("Can not get image list %s", err)
+	}
+	// 派生イメージを先に消すためにプールのイメージから削除する
+	for _, parent := range []bool{false, true} {
+		for _, img := range images {
+			if (img.Labels[parentImageLabel] == "") != parent {
+				continue
+			}
+			for _, tag := range img.RepoTags {
+				if current[tag] {
+					continue
+				}
+				log.Println("Remove image", tag)
+				if _, err := config.Cli.ImageRemove(config.Ctx, tag, image.RemoveOptions{PruneChildren: true}); err != nil {
+					log.Println("Can not remove image", tag, err)
+				}
+			}
+		}
+	}
+
+	if _, err := os.Stat(warmDir); err == nil {
+		log.Println("Remove", warmDir)
+		if err := os.RemoveAll(warmDir); err != nil {
+			log.Println("Can not remove", warmDir, err)
+		}
+	}
+
+	for _, backend := range config.usedBackends() {
+		if err := backend.cleanup(config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSetPoolLimit(t *testing.T) {
+	type want struct {
+		config string
+		err    error
+	}
+	tests := []struct {
+		name  string
+		path  string
+		param string
+		pool  string
+		want  want
+	}{
+		{
+			name:  "default pool",
+			path:  "config.json",
+			param: "{\n  \"runner\": {\"owner\": \"tkmsaaaam\"},\n  \"limit\":  1\n}\n",
+			pool:  "default",
+			want:  want{config: "{\n  \"runner\": {\"owner\": \"tkmsaaaam\"},\n  \"limit\":  3\n}\n", err: nil},
+		},
+		{
+			name:  "default pool without limit",
+			path:  "config.json",
+			param: "{\n  \"runner\": {\"owner\": \"tkmsaaaam\"}\n}\n",
+			pool:  "default",
+			want:  want{config: "{\n  \"limit\": 3,\n  \"runner\": {\"owner\": \"tkmsaaaam\"}\n}\n", err: nil},
+		},
+		{
+			name:  "named pool",
+			path:  "config.json",
+			param: `{"pools": [{"name": "go", "limit": 1}, {"name": "node", "limit": {"nested": [1]}}]}`,
+			pool:  "node",
+			want:  want{config: `{"pools": [{"name": "go", "limit": 1}, {"name": "node", "limit": 3}]}`, err: nil},
+		},
+		{
+			name:  "named pool without limit",
+			path:  "config.json",
+			param: `{"limit": 1, "pools": [{"name": "go"}, {}]}`,
+			pool:  "go",
+			want:  want{config: `{"limit": 1, "pools": [{"limit": 3,"name": "go"}, {}]}`, err: nil},
+		},
+		{
+			name:  "pool is not present",
+			path:  "config.json",
+			param: `{"pools": [{"name": "go", "limit": 1}]}`,
+			pool:  "default",
+			want:  want{config: "", err: fmt.Errorf("Can not find pool default")},
+		},
+		{
+			name:  "yaml",
+			path:  "config.yaml",
+			param: "# runners\nrunner:\n  owner: tkmsaaaam\npools:\n  - name: go\n    limit: 1 # small\n  - name: node\n",
+			pool:  "node",
+			want:  want{config: "# runners\nrunner:\n  owner: tkmsaaaam\npools:\n  - name: go\n    limit: 1 # small\n  - name: node\n    limit: 3\n", err: nil},
+		},
+		{
+			name:  "yaml default pool",
+			path:  "config.yml",
+			param: "limit: 1 # small\nrunner:\n  owner: tkmsaaaam\n",
+			pool:  "default",
+			want:  want{config: "limit: 3 # small\nrunner:\n  owner: tkmsaaaam\n", err: nil},
+		},
+		{
+			name:  "toml",
+			path:  "config.toml",
+			param: "limit = 1\n",
+			pool:  "default",
+			want:  want{config: "", err: fmt.Errorf("scale can not rewrite TOML config files, change the limit of default in config.toml")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual, actualError := setPoolLimit(tt.path, []byte(tt.param), tt.pool, 3)
+
+			if string(actual) != tt.want.config {
+				t.Errorf("setPoolLimit() = \n%v, want \n%v", string(actual), tt.want.config)
+			}
+			assert(t, "setPoolLimit() error", actualError, tt.want.err)
+		})
+	}
+}
+
+func TestImageRepository(t *testing.T) {
+	tests := []struct {
+		name  string
+		param string
+		want  string
+	}{
+		{
+			name:  "local",
+			param: "local-runner:Noble-2.322.0",
+			want:  "local-runner",
+		},
+		{
+			name:  "registry with port",
+			param: "localhost:5000/local-runner:Noble-2.322.0",
+			want:  "localhost:5000/local-runner",
+		},
+		{
+			name:  "no tag",
+			param: "localhost:5000/local-runner",
+			want:  "localhost:5000/local-runner",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := imageRepository(tt.param)
+
+			if actual != tt.want {
+				t.Errorf("imageRepository() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// 設定を上書きする環境変数の接頭辞
+const envPrefix = "LRC_"
+
+// 環境変数で上書きできる設定の項目
+type envOverride struct {
+	Name string
+	Path []string
+	Kind reflect.Kind
+}
+
+// 設定ファイルを拡張子に応じて読み込み、環境変数で上書きしたJSONを返す
+func readConfig(path string) ([]byte, error) {
+	overrides, err := envOverrides(os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		// 環境変数だけで設定することもできる
+		if !os.IsNotExist(err) || len(overrides) == 0 {
+			return nil, fmt.Errorf("Config file (%s) is not present.", path)
+		}
+		data = nil
+	}
+	env, err := decodeConfigFile(path, data)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range overrides {
+		setPath(env, o.path, o.value)
+	}
+	if len(overrides) == 0 && isJson(path) {
+		return data, nil
+	}
+	return json.Marshal(env)
+}
+
+func isJson(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext != ".yaml" && ext != ".yml" && ext != ".toml"
+}
+
+func decodeConfigFile(path string, data []byte) (map[string]any, error) {
+	env := map[string]any{}
+	if len(data) == 0 {
+		return env, nil
+	}
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &env)
+	case ".toml":
+		err = toml.Unmarshal(data, &env)
+	default:
+		err = json.Unmarshal(data, &env)
+		var syntaxError *json.SyntaxError
+		if errors.As(err, &syntaxError) {
+			return nil, fmt.Errorf("Config file (%s) is invalid. %w", path, toConfigError(data, 0, err))
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Config file (%s) is invalid. %s", path, err)
+	}
+	if env == nil {
+		env = map[string]any{}
+	}
+	return env, nil
+}
+
+type overrideValue struct {
+	path  []string
+	value any
+}
+
+// LRC_RUNNER_OWNERのような環境変数から上書きする値を作る
+func envOverrides(environ []string) ([]overrideValue, error) {
+	names := map[string]envOverride{}
+	for _, o := range overridableFields(reflect.TypeOf(Env{}), nil) {
+		names[o.Name] = o
+	}
+	values := []overrideValue{}
+	for _, kv := range environ {
+		name, raw, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		o, ok := names[name]
+		if !ok {
+			continue
+		}
+		var value any
+		switch o.Kind {
+		case reflect.Int:
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a number: %s", name, raw)
+			}
+			value = n
+		case reflect.Bool:
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a boolean: %s", name, raw)
+			}
+			value = b
+		case reflect.Slice:
+			items := []any{}
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			value = items
+		default:
+			value = raw
+		}
+		values = append(values, overrideValue{path: o.Path, value: value})
+	}
+	slices.SortFunc(values, func(a, b overrideValue) int {
+		return strings.Compare(strings.Join(a.path, "."), strings.Join(b.path, "."))
+	})
+	return values, nil
+}
+
+// 環境変数で上書きできる文字列、数値、真偽値、文字列の配列の項目
+func overridableFields(t reflect.Type, path []string) []envOverride {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	fields := []envOverride{}
+	for _, f := range jsonFields(t) {
+		p := append(slices.Clone(path), jsonName(f))
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		switch ft.Kind() {
+		case reflect.Struct:
+			fields = append(fields, overridableFields(ft, p)...)
+		case reflect.String, reflect.Int, reflect.Bool:
+			fields = append(fields, envOverride{Name: envName(p), Path: p, Kind: ft.Kind()})
+		case reflect.Slice:
+			if ft.Elem().Kind() == reflect.String {
+				fields = append(fields, envOverride{Name: envName(p), Path: p, Kind: reflect.Slice})
+			}
+		}
+	}
+	return fields
+}
+
+func envName(path []string) string {
+	return envPrefix + strings.ToUpper(strings.Join(path, "_"))
+}
+
+func setPath(env map[string]any, path []string, value any) {
+	m := env
+	for _, key := range path[:len(path)-1] {
+		child, ok := m[key].(map[string]any)
+		if !ok {
+			child = map[string]any{}
+			m[key] = child
+		}
+		m = child
+	}
+	m[path[len(path)-1]] = value
+}
+
+// JSON以外の設定ファイルではJSONに変換した後の行と列を取り除く
+func configFileError(path string, err error) error {
+	var configError *ConfigError
+	if isJson(path) || !errors.As(err, &configError) {
+		return err
+	}
+	stripped := *configError
+	stripped.Line, stripped.Column = 0, 0
+	return fmt.Errorf("Config file (%s) is invalid. %w", path, &stripped)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.json": `{"runner": {"owner": "tkmsaaaam", "auth": {"access_token": "xxx"}}, "limit": 1}`,
+		"config.yaml": "runner:\n  owner: tkmsaaaam\n  auth:\n    access_token: xxx\nlimit: 1\n",
+		"config.toml": "limit = 1\n[runner]\nowner = \"tkmsaaaam\"\n[runner.auth]\naccess_token = \"xxx\"\n",
+		"broken.yaml": "runner: [\n",
+		"extra.yaml":  "runner:\n  owner: tkmsaaaam\n  token: xxx\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type want struct {
+		owner string
+		limit int
+		err   error
+	}
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		want want
+	}{
+		{
+			name: "json",
+			file: "config.json",
+			want: want{owner: "tkmsaaaam", limit: 1},
+		},
+		{
+			name: "yaml",
+			file: "config.yaml",
+			want: want{owner: "tkmsaaaam", limit: 1},
+		},
+		{
+			name: "toml",
+			file: "config.toml",
+			want: want{owner: "tkmsaaaam", limit: 1},
+		},
+		{
+			name: "env overrides file",
+			file: "config.yaml",
+			env:  map[string]string{"LRC_RUNNER_OWNER": "other", "LRC_LIMIT": "3"},
+			want: want{owner: "other", limit: 3},
+		},
+		{
+			name: "env only",
+			file: "not_found.json",
+			env:  map[string]string{"LRC_RUNNER_OWNER": "other", "LRC_RUNNER_AUTH_ACCESS_TOKEN": "xxx"},
+			want: want{owner: "other", limit: 2},
+		},
+		{
+			name: "not present",
+			file: "not_found.json",
+			want: want{err: fmt.Errorf("Config file (%s) is not present.", filepath.Join(dir, "not_found.json"))},
+		},
+		{
+			name: "invalid number",
+			file: "config.yaml",
+			env:  map[string]string{"LRC_LIMIT": "many"},
+			want: want{err: fmt.Errorf("LRC_LIMIT is not a number: many")},
+		},
+		{
+			name: "unknown field in yaml",
+			file: "extra.yaml",
+			want: want{err: fmt.Errorf("Config file (%s) is invalid. runner.token: unknown field", filepath.Join(dir, "extra.yaml"))},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := filepath.Join(dir, tt.file)
+
+			data, err := readConfig(path)
+			if err == nil {
+				var config *Config
+				config, err = parseConfig(data)
+				if err != nil {
+					err = configFileError(path, err)
+				} else {
+					if config.Runner.Owner != tt.want.owner {
+						t.Errorf("readConfig() owner = \n%v, want \n%v", config.Runner.Owner, tt.want.owner)
+					}
+					if config.Limit != tt.want.limit {
+						t.Errorf("readConfig() limit = \n%v, want \n%v", config.Limit, tt.want.limit)
+					}
+				}
+			}
+
+			assert(t, "readConfig() error", err, tt.want.err)
+		})
+	}
+
+	t.Run("broken yaml", func(t *testing.T) {
+		if _, err := readConfig(filepath.Join(dir, "broken.yaml")); err == nil {
+			t.Errorf("readConfig() error = nil, want error")
+		}
+	})
+}
+
+func TestEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		environ []string
+		want    string
+	}{
+		{
+			name:    "string",
+			environ: []string{"LRC_RUNNER_OWNER=tkmsaaaam"},
+			want:    `[{[runner owner] tkmsaaaam}]`,
+		},
+		{
+			name:    "bool and int",
+			environ: []string{"LRC_RUNNER_AUTH_IS_APP=true", "LRC_RUNNER_AUTH_APP_ID=12"},
+			want:    `[{[runner auth app id] 12} {[runner auth is_app] true}]`,
+		},
+		{
+			name:    "string list",
+			environ: []string{"LRC_LABELS=gpu, linux,"},
+			want:    `[{[labels] [gpu linux]}]`,
+		},
+		{
+			name:    "ignored",
+			environ: []string{"LRC_POOLS=a", "LRC_UNKNOWN=a", "HOME=/root"},
+			want:    `[]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual, err := envOverrides(tt.environ)
+
+			assert(t, "envOverrides() error", err, nil)
+			if fmt.Sprint(actual) != tt.want {
+				t.Errorf("envOverrides() = \n%v, want \n%v", fmt.Sprint(actual), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// 起動してからこの時間以内に失敗して終了したコンテナはすぐに作り直さない
+const fastFailure = 30 * time.Second
+
+// 続けて失敗した時に次のコンテナを作るまで待つ時間。失敗するごとに倍にする
+const crashBackoff = 5 * time.Second
+const maxCrashBackoff = 5 * time.Minute
+
+// この回数続けて失敗したプールは劣化状態とする
+const degradedFailures = 5
+
+// エラーに含めるコンテナのログの行数
+const crashLogLines = 20
+
+// 作成してから起動するまでの間のコンテナを消さないように、この時間より古い起動していないコンテナだけ消す
+const staleCreated = time.Minute
+
+// コントローラーが止めたコンテナの終了コード
+var stopExitCodes = []int{137, 143}
+
+// 終了したコンテナの情報
+type ContainerExit struct {
+	Name     string
+	ExitCode int
+	Lifetime time.Duration
+	Logs     string
+	Usage    *Usage
+}
+
+func (exit *ContainerExit) failed() bool {
+	for _, code := range stopExitCodes {
+		if exit.ExitCode == code {
+			return false
+		}
+	}
+	return exit.ExitCode != 0 && exit.Lifetime < fastFailure
+}
+
+func (exit *ContainerExit) Error() string {
+	msg := fmt.Sprintf("container %s exited with %d after %s", exit.Name, exit.ExitCode, exit.Lifetime.Round(time.Second))
+	if exit.Logs != "" {
+		msg += "\n" + exit.Logs
+	}
+	return msg
+}
+
+func (pool *Pool) degraded() bool {
+	return pool.Failures >= degradedFailures
+}
+
+// 終了したコンテナを記録し、すぐに失敗した場合は待つ時間を返す
+func (pool *Pool) recordExit(exit *ContainerExit, now time.Time) time.Duration {
+	if !exit.failed() {
+		if pool.Failures > 0 {
+			log.Println("pool", pool.Name, "recovered")
+		}
+		pool.Failures = 0
+		pool.BackoffUntil = time.Time{}
+		pool.LastError = ""
+		return 0
+	}
+	return pool.recordFailure(exit, now)
+}
+
+// プールの失敗を記録し、次に試すまで待つ時間を返す
+func (pool *Pool) recordFailure(err error, now time.Time) time.Duration {
+	pool.Failures++
+	backoff := maxCrashBackoff
+	if pool.Failures <= 16 {
+		backoff = min(crashBackoff<<(pool.Failures-1), maxCrashBackoff)
+	}
+	pool.BackoffUntil = now.Add(backoff)
+	pool.LastError = err.Error()
+	log.Printf("pool %s failed %d times, retry in %s: %s", pool.Name, pool.Failures, backoff, pool.LastError)
+	if pool.Failures == degradedFailures {
+		log.Printf("pool %s is degraded", pool.Name)
+	}
+	return backoff
+}
+
+// 終了したコンテナをプールに記録する。すぐに失敗していた場合は待ち終わった時にresyncに通知する
+func (config *Config) containerExited(id, poolName string) {
+	exit, err := config.reapContainer(id)
+	if err != nil {
+		log.Println(err)
+	}
+	if exit == nil {
+		return
+	}
+	config.mu.Lock()
+	backoff := time.Duration(0)
+	if pool := config.findPoolLocked(poolName); pool != nil {
+		backoff = pool.recordExit(exit, time.Now())
+	}
+	config.mu.Unlock()
+	config.resyncAfter(backoff)
+}
+
+// 待ち終わった時にresyncに通知する
+func (config *Config) resyncAfter(backoff time.Duration) {
+	if backoff <= 0 || config.resyncChan == nil {
+		return
+	}
+	time.AfterFunc(backoff, func() {
+		select {
+		case config.resyncChan <- true:
+		default:
+		}
+	})
+}
+
+// 終了したコンテナの終了コード、起動していた時間、最後のログを取り出してから削除する
+func (config *Config) reapContainer(id string) (*ContainerExit, error) {
+	info, err := config.Cli.ContainerInspect(config.Ctx, id)
+	if err != nil {
+		// 止めたコンテナは既に削除している
+		if errdefs.IsNotFound(err) {
+			usageSamplers.drop(id)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Can not inspect container %s %s", id, err)
+	}
+	exit := &ContainerExit{Name: strings.TrimPrefix(info.Name, "/")}
+	if info.State != nil {
+		exit.ExitCode = info.State.ExitCode
+		started, err1 := time.Parse(time.RFC3339Nano, info.State.StartedAt)
+		finished, err2 := time.Parse(time.RFC3339Nano, info.State.FinishedAt)
+		if err1 == nil && err2 == nil {
+			exit.Lifetime = finished.Sub(started)
+		}
+	}
+	if exit.failed() {
+		exit.Logs = config.containerLogs(id, crashLogLines)
+	}
+	// 削除する前にログと統計を取り終え、ジョブを記録する
+	logCaptures.wait(id, logFlushTimeout)
+	exit.Usage = usageSamplers.take(id, usageFlushTimeout)
+	config.recordJob(id, info, exit)
+	if err := config.Cli.ContainerRemove(config.Ctx, id, container.RemoveOptions{Force: true}); err != nil && !errdefs.IsNotFound(err) {
+		log.Println("Can not remove container", id, err)
+	}
+	return exit, nil
+}
+
+func (config *Config) containerLogs(id string, lines int) string {
+	reader, err := config.Cli.ContainerLogs(config.Ctx, id, container.LogsOptions{ShowStdout: true, ShowStderr: true, Tail: fmt.Sprint(lines)})
+	if err != nil {
+		log.Println("Can not get logs", id, err)
+		return ""
+	}
+	defer reader.Close()
+	var buf bytes.Buffer
+	if _, err := stdcopy.StdCopy(&buf, &buf, reader); err != nil {
+		log.Println("Can not read logs", id, err)
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// dieイベントを取りこぼして残った、終了したコンテナと起動に失敗したコンテナを削除する
+func (config *Config) removeExitedContainers() {
+	list, err := config.Cli.ContainerList(config.Ctx, container.ListOptions{All: true, Filters: filters.NewArgs(
+		filters.KeyValuePair{Key: "label", Value: poolLabel},
+		filters.KeyValuePair{Key: "status", Value: "exited"},
+		filters.KeyValuePair{Key: "status", Value: "created"},
+	)})
+	if err != nil {
+		log.Println("Can not get containers list", err)
+		return
+	}
+	for _, c := range list {
+		if c.State == "created" && time.Since(time.Unix(c.Created, 0)) < staleCreated {
+			continue
+		}
+		if err := backendOf(c.Labels[backendLabel]).exited(config, containerName(c), runnerLabels(containerName(c), c.Labels)); err != nil {
+			log.Println(err)
+		}
+		removeWarmFiles(containerName(c))
+		// 起動していないコンテナの終了は失敗にも回復にも数えない
+		if c.State == "created" {
+			if _, err := config.reapContainer(c.ID); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		config.containerExited(c.ID, c.Labels[poolLabel])
+	}
+}
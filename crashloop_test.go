@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContainerExitFailed(t *testing.T) {
+	tests := []struct {
+		name  string
+		param *ContainerExit
+		want  bool
+	}{
+		{
+			name:  "fast failure",
+			param: &ContainerExit{ExitCode: 1, Lifetime: time.Second},
+			want:  true,
+		},
+		{
+			name:  "job finished",
+			param: &ContainerExit{ExitCode: 0, Lifetime: time.Second},
+			want:  false,
+		},
+		{
+			name:  "failed after a job",
+			param: &ContainerExit{ExitCode: 1, Lifetime: time.Hour},
+			want:  false,
+		},
+		{
+			name:  "stopped by controller",
+			param: &ContainerExit{ExitCode: 143, Lifetime: time.Second},
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := tt.param.failed()
+
+			if actual != tt.want {
+				t.Errorf("failed() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolRecordExit(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	pool := &Pool{Name: "go"}
+	failure := &ContainerExit{Name: "local-runner-go-1", ExitCode: 1, Lifetime: 2 * time.Second, Logs: "Invalid jit config"}
+
+	backoffs := []time.Duration{}
+	for i := 0; i < 8; i++ {
+		backoffs = append(backoffs, pool.recordExit(failure, now))
+		if pool.degraded() != (i+1 >= degradedFailures) {
+			t.Errorf("degraded() after %d failures = %v", i+1, pool.degraded())
+		}
+	}
+
+	want := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 160 * time.Second, 5 * time.Minute, 5 * time.Minute}
+	for i := range want {
+		if backoffs[i] != want[i] {
+			t.Errorf("recordExit() = \n%v, want \n%v", backoffs, want)
+			break
+		}
+	}
+	if !pool.BackoffUntil.Equal(now.Add(5 * time.Minute)) {
+		t.Errorf("pool.BackoffUntil = \n%v", pool.BackoffUntil)
+	}
+	if pool.LastError != "container local-runner-go-1 exited with 1 after 2s\nInvalid jit config" {
+		t.Errorf("pool.LastError = \n%v", pool.LastError)
+	}
+
+	if backoff := pool.recordExit(&ContainerExit{ExitCode: 0, Lifetime: time.Minute}, now); backoff != 0 {
+		t.Errorf("recordExit() = \n%v, want \n%v", backoff, 0)
+	}
+	if pool.Failures != 0 || pool.degraded() || pool.LastError != "" || !pool.BackoffUntil.IsZero() {
+		t.Errorf("recordExit() did not reset the pool %v", pool)
+	}
+}
+
+func TestPrintStatusDegraded(t *testing.T) {
+	statuses := []PoolStatus{
+		{Name: "go", Limit: 1, Image: "local-runner:go", Degraded: true, Failures: 5, LastError: "container local-runner-go-1 exited with 1 after 2s"},
+		{Name: "node", Limit: 1, Image: "local-runner:node"},
+	}
+	var buf bytes.Buffer
+
+	if err := printStatus(&buf, statuses); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "Pool go is degraded. Last error: container local-runner-go-1 exited with 1 after 2s") || strings.Contains(buf.String(), "Pool node") {
+		t.Errorf("printStatus() = \n%v", buf.String())
+	}
+}
@@ -0,0 +1,22 @@
+#!/bin/bash
+if [ -e "/usr/local/share/ca-certificates/local-runner-ca.crt" ]; then
+  update-ca-certificates > /dev/null
+fi
+if [ -d "/mnt/local-runner" ]; then
+  # 待機するコンテナはコントローラーが登録の設定を書き出すまで待つ
+  while [ ! -e "/mnt/local-runner/runner.env" ]; do
+    sleep 0.2
+  done
+  cp -R /mnt/local-runner/files/. / 2> /dev/null
+  set -a
+  . /mnt/local-runner/runner.env
+  set +a
+fi
+exec gitlab-runner run-single \
+  --url "$GITLAB_URL" \
+  --token "`cat /mnt/runner-token.txt`" \
+  --name "`hostname`" \
+  --executor shell \
+  --builds-dir /actions-runner/builds \
+  --cache-dir /actions-runner/cache \
+  --max-builds 1
@@ -1,23 +1,15 @@
 #!/bin/bash
-export url=""
-export target=""
-if [ -z "$GITHUB_REPOSITORY_NAME" ]; then
-  url="https://$GITHUB_API_DOMAIN/orgs/$GITHUB_REPOSITORY_OWNER"
-  target=$GITHUB_REPOSITORY_OWNER
-else
-  url="https://$GITHUB_API_DOMAIN/repos/$GITHUB_REPOSITORY_OWNER/$GITHUB_REPOSITORY_NAME"
-  target=$GITHUB_REPOSITORY_OWNER/$GITHUB_REPOSITORY_NAME
+if [ -e "/usr/local/share/ca-certificates/local-runner-ca.crt" ]; then
+  update-ca-certificates > /dev/null
 fi
-if [ -e "/mnt/pat.txt" ]; then
-  export GITHUB_ACCESS_TOKEN=`cat /mnt/pat.txt`
-else
-  export GITHUB_ACCESS_TOKEN=`/actions-runner/jwt`
+if [ -d "/mnt/local-runner" ]; then
+  # 待機するコンテナはコントローラーが登録の設定を書き出すまで待つ
+  while [ ! -e "/mnt/local-runner/runner.env" ]; do
+    sleep 0.2
+  done
+  cp -R /mnt/local-runner/files/. / 2> /dev/null
+  set -a
+  . /mnt/local-runner/runner.env
+  set +a
 fi
-export TOKEN=`curl -L \
-  -X POST \
-  -H "Accept: application/vnd.github+json" \
-  -H "Authorization: Bearer $GITHUB_ACCESS_TOKEN" \
-  -H "X-GitHub-Api-Version: 2022-11-28" \
-  $url/actions/runners/registration-token | jq -r .token`
-/actions-runner/config.sh --url https://$GITHUB_DOMAIN/$target --token $TOKEN --ephemeral --labels $LABELS
-/actions-runner/run.sh --ephemeral
+exec /actions-runner/run.sh --jitconfig "$JIT_CONFIG"
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ランナーに渡すプロキシの設定
+type Proxy struct {
+	HttpProxy  string `json:"http_proxy"`
+	HttpsProxy string `json:"https_proxy"`
+	NoProxy    string `json:"no_proxy"`
+}
+
+// コンテナ内でCAバンドルをマウントする場所。start.shでupdate-ca-certificatesする
+const containerCaBundle = "/usr/local/share/ca-certificates/local-runner-ca.crt"
+
+// コントローラーとランナーが信頼するCAバンドル
+func (config *Config) caBundle() string {
+	if config.Runner == nil {
+		return ""
+	}
+	return config.Runner.CaBundle
+}
+
+// GitHub APIのURL。GitHub Enterprise ServerのAPIは/api/v3の下にある
+func (runner *Runner) apiUrl() string {
+	base := runner.ApiDomain
+	if !strings.Contains(base, "://") {
+		base = "https://" + base
+	}
+	base = strings.TrimSuffix(base, "/")
+	if runner.Domain != "github.com" && runner.ApiDomain == runner.Domain {
+		base += "/api/v3"
+	}
+	return base
+}
+
+func (proxy *Proxy) validate() error {
+	for _, p := range []string{proxy.HttpProxy, proxy.HttpsProxy} {
+		if p == "" {
+			continue
+		}
+		u, err := url.Parse(p)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("Invalid proxy url %s", p)
+		}
+	}
+	return nil
+}
+
+// コンテナに渡すプロキシの環境変数。ツールによって大文字と小文字のどちらを読むかが違うので両方渡す
+func (proxy *Proxy) env() []string {
+	if proxy == nil {
+		return nil
+	}
+	env := []string{}
+	for _, kv := range [][2]string{{"http_proxy", proxy.HttpProxy}, {"https_proxy", proxy.HttpsProxy}, {"no_proxy", proxy.NoProxy}} {
+		if kv[1] != "" {
+			env = append(env, kv[0]+"="+kv[1], strings.ToUpper(kv[0])+"="+kv[1])
+		}
+	}
+	return env
+}
+
+func readCaBundle(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can not read ca_bundle %s", path)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("ca_bundle %s has no certificates", path)
+	}
+	return pool, nil
+}
+
+// コントローラーからGitHubを呼ぶためのHTTPクライアント。CAバンドルとプロキシを使う
+func newHttpClient(caBundle string, proxy *Proxy) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caBundle != "" {
+		pool, err := readCaBundle(caBundle)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if proxy != nil && (proxy.HttpProxy != "" || proxy.HttpsProxy != "") {
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxy.url(req)
+		}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+func (proxy *Proxy) url(req *http.Request) (*url.URL, error) {
+	host := req.URL.Hostname()
+	for _, p := range strings.Split(proxy.NoProxy, ",") {
+		p = strings.TrimPrefix(strings.TrimSpace(p), ".")
+		if p != "" && (host == p || strings.HasSuffix(host, "."+p)) {
+			return nil, nil
+		}
+	}
+	p := proxy.HttpProxy
+	if req.URL.Scheme == "https" {
+		p = proxy.HttpsProxy
+	}
+	if p == "" {
+		return nil, nil
+	}
+	return url.Parse(p)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestApiUrl(t *testing.T) {
+	tests := []struct {
+		name  string
+		param *Runner
+		want  string
+	}{
+		{
+			name:  "github.com",
+			param: &Runner{},
+			want:  "https://api.github.com",
+		},
+		{
+			name:  "enterprise server",
+			param: &Runner{Domain: "ghes.example.com"},
+			want:  "https://ghes.example.com/api/v3",
+		},
+		{
+			name:  "separate api domain",
+			param: &Runner{Domain: "example.ghe.com", ApiDomain: "api.example.ghe.com"},
+			want:  "https://api.example.ghe.com",
+		},
+		{
+			name:  "api url",
+			param: &Runner{Domain: "ghes.example.com", ApiDomain: "http://localhost:8080/api/v3/"},
+			want:  "http://localhost:8080/api/v3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			tt.param.setDefaultValue()
+			actual := tt.param.apiUrl()
+
+			if actual != tt.want {
+				t.Errorf("runner.apiUrl() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		param *Proxy
+		want  []string
+	}{
+		{
+			name:  "nil",
+			param: nil,
+			want:  nil,
+		},
+		{
+			name:  "https and no_proxy",
+			param: &Proxy{HttpsProxy: "http://proxy:3128", NoProxy: "localhost,.example.com"},
+			want:  []string{"https_proxy=http://proxy:3128", "HTTPS_PROXY=http://proxy:3128", "no_proxy=localhost,.example.com", "NO_PROXY=localhost,.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := tt.param.env()
+
+			if !slices.Equal(actual, tt.want) {
+				t.Errorf("proxy.env() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyUrl(t *testing.T) {
+	proxy := &Proxy{HttpProxy: "http://proxy:3128", HttpsProxy: "http://secure-proxy:3128", NoProxy: "localhost, .example.com"}
+	tests := []struct {
+		name  string
+		param string
+		want  string
+	}{
+		{
+			name:  "http",
+			param: "http://github.com",
+			want:  "http://proxy:3128",
+		},
+		{
+			name:  "https",
+			param: "https://api.github.com",
+			want:  "http://secure-proxy:3128",
+		},
+		{
+			name:  "no_proxy",
+			param: "https://ghes.example.com/api/v3",
+			want:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			u, _ := url.Parse(tt.param)
+			actual, err := proxy.url(&http.Request{URL: u})
+
+			got := ""
+			if actual != nil {
+				got = actual.String()
+			}
+			assert(t, "proxy.url() error", err, nil)
+			if got != tt.want {
+				t.Errorf("proxy.url() = \n%v, want \n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewHttpClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte(""), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("trusts ca_bundle", func(t *testing.T) {
+		client, err := newHttpClient(bundle, nil)
+		assert(t, "newHttpClient() error", err, nil)
+		res, err := client.Get(server.URL)
+		assert(t, "client.Get() error", err, nil)
+		if err == nil {
+			res.Body.Close()
+		}
+	})
+	t.Run("does not trust unknown ca", func(t *testing.T) {
+		client, err := newHttpClient("", nil)
+		assert(t, "newHttpClient() error", err, nil)
+		if _, err := client.Get(server.URL); err == nil {
+			t.Errorf("client.Get() error = nil, want error")
+		}
+	})
+	t.Run("no certificates", func(t *testing.T) {
+		_, err := newHttpClient(empty, nil)
+		assert(t, "newHttpClient() error", err, fmt.Errorf("ca_bundle %s has no certificates", empty))
+	})
+}
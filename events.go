@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// 取りこぼしたdieイベントを補うためにコンテナ数を確認する間隔
+const resyncInterval = time.Minute
+
+// イベントの購読が切れた時に再接続するまでの待ち時間
+const eventBackoff = time.Second
+const maxEventBackoff = 30 * time.Second
+
+// Dockerのイベントを購読し直しながら受け取る
+type EventWatcher struct {
+	Subscribe  func(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error)
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func (config *Config) eventWatcher() *EventWatcher {
+	return &EventWatcher{Subscribe: config.Cli.Events, Backoff: eventBackoff, MaxBackoff: maxEventBackoff}
+}
+
+// プールのコンテナのdieイベントをoutに送る。再接続した時はイベントを取りこぼしたかもしれないのでresyncに通知する
+func (w *EventWatcher) watch(out chan<- events.Message, resync chan<- bool, stop <-chan bool) {
+	since := time.Now()
+	var last int64
+	backoff := w.Backoff
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		options := events.ListOptions{
+			// 切れている間のイベントも受け取る
+			Since: fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond()),
+			Filters: filters.NewArgs(
+				filters.KeyValuePair{Key: "type", Value: string(events.ContainerEventType)},
+				filters.KeyValuePair{Key: "event", Value: string(events.ActionDie)},
+				filters.KeyValuePair{Key: "label", Value: poolLabel},
+			),
+		}
+		messages, errs := w.Subscribe(ctx, options)
+		err := func() error {
+			for {
+				select {
+				case m := <-messages:
+					// Sinceと同じ時刻のイベントは2回届く
+					if m.TimeNano != 0 && m.TimeNano <= last {
+						continue
+					}
+					last = m.TimeNano
+					since = time.Unix(0, m.TimeNano)
+					backoff = w.Backoff
+					select {
+					case out <- m:
+					case <-stop:
+						return nil
+					}
+				case err := <-errs:
+					return err
+				case <-stop:
+					return nil
+				}
+			}
+		}()
+		cancel()
+		if err == nil {
+			return
+		}
+		log.Println("Error while listening to Docker events, reconnect in", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return
+		}
+		backoff = min(backoff*2, w.MaxBackoff)
+		select {
+		case resync <- true:
+		default:
+		}
+	}
+}
+
+// 取りこぼしたイベントがあってもプールのコンテナ数を上限まで戻す
+func (config *Config) resync() {
+	config.Logs.prune(time.Now())
+	config.History.prune(time.Now())
+	config.removeExitedContainers()
+	if ee := config.handleContainer(); ee != nil {
+		log.Println("Can not resync containers", *ee)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+func TestEventWatcher(t *testing.T) {
+	first := events.Message{Actor: events.Actor{ID: "1"}, TimeNano: 1700000000000000001}
+	second := events.Message{Actor: events.Actor{ID: "2"}, TimeNano: 1700000000000000002}
+	since := []string{}
+	subscribe := func(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
+		since = append(since, options.Since)
+		messages := make(chan events.Message, 2)
+		errs := make(chan error, 1)
+		if len(since) == 1 {
+			messages <- first
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				errs <- fmt.Errorf("unexpected EOF")
+			}()
+		} else {
+			// 再接続するとSinceと同じ時刻のイベントがもう一度届く
+			messages <- first
+			messages <- second
+		}
+		return messages, errs
+	}
+	watcher := &EventWatcher{Subscribe: subscribe, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	out := make(chan events.Message)
+	resync := make(chan bool, 1)
+	stop := make(chan bool)
+	defer close(stop)
+
+	go watcher.watch(out, resync, stop)
+
+	received := []string{}
+	for len(received) < 2 {
+		select {
+		case m := <-out:
+			received = append(received, m.Actor.ID)
+		case <-time.After(time.Second):
+			t.Fatalf("watch() received = %v", received)
+		}
+	}
+	if fmt.Sprint(received) != "[1 2]" {
+		t.Errorf("watch() received = \n%v, want \n%v", received, "[1 2]")
+	}
+	if len(since) != 2 || since[1] != "1700000000.000000001" {
+		t.Errorf("watch() since = \n%v", since)
+	}
+	select {
+	case <-resync:
+	default:
+		t.Errorf("watch() did not request resync after reconnecting")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// Forgejo/GiteaのActionsにランナーを登録する先
+type Forgejo struct {
+	Url           string `json:"url" schema:"required"`
+	Owner         string `json:"owner" schema:"required"`
+	Repository    string `json:"repository"`
+	Token         string `json:"token" schema:"required"`
+	RunnerVersion string `json:"runner_version"`
+
+	tokenCache SecretCache
+}
+
+const forgejoBackend = "forgejo"
+
+const defaultActRunnerVersion = "0.2.12"
+
+// 登録トークンをコンテナにマウントするために書き出すディレクトリ。コンテナごとにファイルを分ける
+const forgejoTokenDir = "./forgejo-tokens"
+
+const forgejoStartScript = "forgejo-start.sh"
+
+func (forgejo *Forgejo) validate() error {
+	u, err := url.Parse(forgejo.Url)
+	if forgejo.Url == "" || err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("url is invalid %s", forgejo.Url)
+	}
+	if forgejo.Owner == "" {
+		return fmt.Errorf("owner is required")
+	}
+	if forgejo.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	return nil
+}
+
+func (forgejo *Forgejo) setDefaultValue() {
+	forgejo.Url = strings.TrimSuffix(forgejo.Url, "/")
+	if forgejo.RunnerVersion == "" {
+		forgejo.RunnerVersion = defaultActRunnerVersion
+	}
+}
+
+func (forgejo *Forgejo) scopePath() string {
+	if forgejo.Repository == "" {
+		return "/orgs/" + forgejo.Owner
+	}
+	return "/repos/" + forgejo.Owner + "/" + forgejo.Repository
+}
+
+// Forgejo/GiteaのAPIはGitHubと同じ形なので同じクライアントを使う
+func (config *Config) forgejoApi() *GitHub {
+	return &GitHub{
+		ApiBase: config.Forgejo.Url + "/api/v1",
+		Token:   config.Forgejo.token,
+		Refresh: config.Forgejo.tokenCache.reset,
+		Client:  config.HttpClient,
+		Limit:   rateLimits.get(config.Forgejo.Url + "/api/v1"),
+	}
+}
+
+func (forgejo *Forgejo) token() (string, error) {
+	return forgejo.tokenCache.get(forgejo.Token, "forgejo.token")
+}
+
+func (gh *GitHub) registrationToken(scope string) (string, error) {
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := gh.do(http.MethodGet, scope+"/actions/runners/registration-token", nil, &body); err != nil {
+		return "", err
+	}
+	return body.Token, nil
+}
+
+// act_runnerで動くForgejo/Giteaのランナー
+type ForgejoBackend struct{}
+
+// ベースイメージにact_runnerを追加する
+func (b *ForgejoBackend) dockerfile(config *Config) string {
+	version := config.Forgejo.RunnerVersion
+	return "\nRUN case $(dpkg --print-architecture) in \\\n" +
+		"    armhf) arch=arm-7 ;; \\\n" +
+		"    *) arch=$(dpkg --print-architecture) ;; \\\n" +
+		"  esac && \\\n" +
+		"  curl -fsSL -o /actions-runner/act_runner https://gitea.com/gitea/act_runner/releases/download/v" + version + "/act_runner-" + version + "-linux-${arch} && \\\n" +
+		"  chmod +x /actions-runner/act_runner\n" +
+		"\nCOPY " + forgejoStartScript + " /actions-runner/" + forgejoStartScript + "\n" +
+		"CMD [\"/bin/bash\", \"-c\", \"/actions-runner/" + forgejoStartScript + "\"]\n"
+}
+
+func (b *ForgejoBackend) addTo(config *Config, tw *tar.Writer) error {
+	data, err := os.ReadFile(templateDir + "/" + forgejoStartScript)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", forgejoStartScript, err)
+	}
+	return addTarFile(tw, forgejoStartScript, data, 0755)
+}
+
+func (b *ForgejoBackend) runnerName(pool *Pool) string {
+	return randomRunnerName(pool)
+}
+
+func (b *ForgejoBackend) containerSpec(config *Config, pool *Pool, name string) (*ContainerSpec, error) {
+	token, err := config.forgejoApi().forPool().registrationToken(config.Forgejo.scopePath())
+	if err != nil {
+		return nil, fmt.Errorf("Can not get registration token %s", err)
+	}
+	if err := os.MkdirAll(forgejoTokenDir, 0700); err != nil {
+		return nil, fmt.Errorf("Can not create %s %s", forgejoTokenDir, err)
+	}
+	abspath, err := writeSecretFile(filepath.Join(forgejoTokenDir, name), []byte(token))
+	if err != nil {
+		return nil, fmt.Errorf("Can not create file %s", err)
+	}
+	// ジョブをコンテナ内で直接実行するラベルにする
+	labels := []string{}
+	for _, l := range config.poolLabels(pool) {
+		labels = append(labels, l+":host")
+	}
+	return &ContainerSpec{
+		Env:    []string{"FORGEJO_INSTANCE=" + config.Forgejo.Url, "LABELS=" + strings.Join(labels, ",")},
+		Binds:  []string{fmt.Sprintf("%s:%s:ro", abspath, "/mnt/registration-token.txt")},
+		Labels: map[string]string{"owner": config.Forgejo.Owner},
+	}, nil
+}
+
+// APIで登録を解除してからコンテナを止める
+func (b *ForgejoBackend) stop(config *Config, c types.Container) error {
+	api := config.forgejoApi()
+	scope := config.Forgejo.scopePath()
+	runners, err := api.listRunners(scope)
+	if err != nil {
+		log.Println("Can not get runners", err)
+	}
+	for _, r := range runners {
+		if "/"+r.Name == c.Names[0] {
+			if err := api.deleteRunner(scope, r.Id); err != nil {
+				log.Println("Can not remove runner", r.Name, err)
+			}
+		}
+	}
+	return config.Cli.ContainerStop(config.Ctx, c.ID, container.StopOptions{})
+}
+
+// エフェメラルなランナーはジョブが終わるとForgejoが登録を削除する。トークンのファイルだけ消す
+func (b *ForgejoBackend) exited(config *Config, name string, labels map[string]string) error {
+	os.Remove(filepath.Join(forgejoTokenDir, name))
+	return nil
+}
+
+func (b *ForgejoBackend) cleanup(config *Config) error {
+	api := config.forgejoApi()
+	scope := config.Forgejo.scopePath()
+	runners, err := api.listRunners(scope)
+	if err != nil {
+		return fmt.Errorf("Can not get forgejo runners %s", err)
+	}
+	removeOfflineRunners(runners, func(r GitHubRunner) error {
+		return api.deleteRunner(scope, r.Id)
+	})
+	return nil
+}
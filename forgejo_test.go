@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Forgejo/GiteaのAPIの代わりに使うサーバー
+func fakeForgejo(t *testing.T, deleted *[]string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/orgs/owner/actions/runners/registration-token", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"token": "registration_token"}`)
+	})
+	mux.HandleFunc("GET /api/v1/orgs/owner/actions/runners", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"total_count": 3, "runners": [
+			{"id": 1, "name": "local-runner-default-1", "status": "offline"},
+			{"id": 2, "name": "local-runner-default-2", "status": "online"},
+			{"id": 3, "name": "other-runner", "status": "offline"}
+		]}`)
+	})
+	mux.HandleFunc("DELETE /api/v1/orgs/owner/actions/runners/{id}", func(w http.ResponseWriter, r *http.Request) {
+		*deleted = append(*deleted, r.PathValue("id"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer api_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestForgejoContainerSpec(t *testing.T) {
+	server := fakeForgejo(t, &[]string{})
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	config := &Config{
+		Forgejo:    &Forgejo{Url: server.URL, Owner: "owner", Token: "api_token"},
+		Labels:     []string{"linux"},
+		HttpClient: server.Client(),
+	}
+	spec, err := (&ForgejoBackend{}).containerSpec(config, &Pool{Name: "default", Labels: []string{"gpu"}, Backend: forgejoBackend}, "local-runner-default-1")
+	assert(t, "containerSpec() error", err, nil)
+	if err != nil {
+		return
+	}
+
+	want := []string{"FORGEJO_INSTANCE=" + server.URL, "LABELS=linux:host,gpu:host"}
+	if !slices.Equal(spec.Env, want) {
+		t.Errorf("containerSpec() env = \n%v, want \n%v", spec.Env, want)
+	}
+	data, err := os.ReadFile(filepath.Join(forgejoTokenDir, "local-runner-default-1"))
+	if err != nil || string(data) != "registration_token" {
+		t.Errorf("containerSpec() token = \n%s, want \n%s", data, "registration_token")
+	}
+	if _, err := (&ForgejoBackend{}).containerSpec(config, &Pool{Name: "default", Backend: forgejoBackend}, "local-runner-default-2"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(spec.Binds[0], "/forgejo-tokens/local-runner-default-1:/mnt/registration-token.txt:ro") {
+		t.Errorf("containerSpec() binds = \n%v", spec.Binds)
+	}
+
+	if err := (&ForgejoBackend{}).exited(config, "local-runner-default-1", map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(forgejoTokenDir, "local-runner-default-1")); !os.IsNotExist(err) {
+		t.Errorf("exited() did not remove the token file")
+	}
+	if _, err := os.Stat(filepath.Join(forgejoTokenDir, "local-runner-default-2")); err != nil {
+		t.Errorf("exited() removed the token file of another container")
+	}
+
+	// 再読み込みと同じく新しい設定ではトークンを解決し直す
+	config.Forgejo = &Forgejo{Url: server.URL, Owner: "owner", Token: "invalid"}
+	_, err = (&ForgejoBackend{}).containerSpec(config, &Pool{Name: "default", Backend: forgejoBackend}, "local-runner-default-1")
+	assert(t, "containerSpec() error", err, fmt.Errorf("Can not get registration token GET /orgs/owner/actions/runners/registration-token status: 401"))
+}
+
+func TestForgejoCleanup(t *testing.T) {
+	deleted := []string{}
+	server := fakeForgejo(t, &deleted)
+	config := &Config{
+		Forgejo:    &Forgejo{Url: server.URL, Owner: "owner", Token: "api_token"},
+		HttpClient: server.Client(),
+	}
+
+	err := (&ForgejoBackend{}).cleanup(config)
+
+	assert(t, "cleanup() error", err, nil)
+	if !slices.Equal(deleted, []string{"1"}) {
+		t.Errorf("cleanup() deleted = \n%v, want \n%v", deleted, []string{"1"})
+	}
+}
+
+func TestParseConfigBackend(t *testing.T) {
+	forgejo := `"forgejo": {"url": "https://codeberg.org", "owner": "owner", "token": "env:FORGEJO_TOKEN"}`
+	runner := `"runner": {"owner": "owner", "auth": {"access_token": "xxx"}}`
+	tests := []struct {
+		name  string
+		param string
+		want  error
+	}{
+		{
+			name:  "forgejo only",
+			param: `{"backend": "forgejo", "labels": ["linux"], ` + forgejo + `}`,
+			want:  nil,
+		},
+		{
+			name:  "both forges",
+			param: `{` + runner + `, ` + forgejo + `, "pools": [{"name": "github"}, {"name": "forgejo", "backend": "forgejo", "labels": ["linux"]}]}`,
+			want:  nil,
+		},
+		{
+			name:  "forgejo is required",
+			param: `{` + runner + `, "pools": [{"name": "forgejo", "backend": "forgejo"}]}`,
+			want:  fmt.Errorf("Forgejo is not valid in config.json forgejo is required by pool forgejo"),
+		},
+		{
+			name:  "labels are required",
+			param: `{"backend": "forgejo", ` + forgejo + `}`,
+			want:  fmt.Errorf("labels are required by pool default of forgejo"),
+		},
+		{
+			name:  "runner is required",
+			param: `{` + forgejo + `, "pools": [{"name": "github"}]}`,
+			want:  fmt.Errorf("Runner is not valid in config.json runner is required"),
+		},
+		{
+			name:  "unknown backend",
+			param: `{` + runner + `, "backend": "jenkins"}`,
+			want:  fmt.Errorf("Unknown backend jenkins of pool default"),
+		},
+		{
+			name:  "invalid url",
+			param: `{"backend": "forgejo", "labels": ["linux"], "forgejo": {"url": "codeberg.org", "owner": "owner", "token": "xxx"}}`,
+			want:  fmt.Errorf("Forgejo is not valid in config.json url is invalid codeberg.org"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			_, err := parseConfig([]byte(tt.param))
+
+			assert(t, "parseConfig() error", err, tt.want)
+		})
+	}
+}
+
+func TestForgejoPoolImageName(t *testing.T) {
+	config := &Config{BaseImage: "Jammy", Version: "2.322.0", Arch: "amd64", Forgejo: &Forgejo{RunnerVersion: defaultActRunnerVersion}}
+	github := &Pool{Name: "github", Overlay: &Layer{}}
+	forgejo := &Pool{Name: "forgejo", Overlay: &Layer{}, Backend: forgejoBackend}
+
+	if actual := config.poolImageName(github); actual != config.imageName() {
+		t.Errorf("poolImageName() = \n%v, want \n%v", actual, config.imageName())
+	}
+	if actual := config.poolImageName(forgejo); actual == config.imageName() {
+		t.Errorf("poolImageName() = \n%v, want an image derived from the base image", actual)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// コントローラーからGitHub APIを呼ぶためのクライアント
+type GitHub struct {
+	ApiBase string
+	Token   func() (string, error)
+	// 認証に失敗した時にトークンを解決し直す。nilなら送り直さない
+	Refresh func()
+	Client  *http.Client
+	Limit   *RateLimit
+	// レート制限で待つ最長の時間。0ならmaxRateLimitWait
+	MaxWait time.Duration
+}
+
+type GitHubRunner struct {
+	Id     int    `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Busy   bool   `json:"busy"`
+}
+
+// APIが2xx以外を返した時のエラー
+type ApiError struct {
+	Method string
+	Path   string
+	Status int
+	Body   string
+}
+
+func (e *ApiError) Error() string {
+	msg := fmt.Sprintf("%s %s status: %d", e.Method, e.Path, e.Status)
+	if e.Body != "" {
+		msg += " " + e.Body
+	}
+	return msg
+}
+
+func isNotFound(err error) bool {
+	var apiError *ApiError
+	return errors.As(err, &apiError) && apiError.Status == http.StatusNotFound
+}
+
+// コンテナ名とGitHubに登録するランナー名の接頭辞
+const runnerNamePrefix = "local-runner-"
+
+func (config *Config) gitHub() *GitHub {
+	return &GitHub{
+		ApiBase: config.Runner.apiUrl(),
+		Token:   config.Runner.Auth.token(config.Runner.apiUrl(), config.HttpClient),
+		Refresh: config.Runner.Auth.refresh(),
+		Client:  config.HttpClient,
+		Limit:   rateLimits.get(config.Runner.apiUrl()),
+	}
+}
+
+// PATまたはGitHub Appのインストールトークンを返す関数
+func (auth *Auth) token(apiUrl string, client *http.Client) func() (string, error) {
+	if !auth.IsApp {
+		return auth.accessToken
+	}
+	fetch := func() (string, time.Time, error) {
+		data, err := auth.privateKey()
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		key, err := parsePrivateKey(data)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		jwt, err := appJwt(auth.App.Id, key, time.Now())
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return installationToken(client, apiUrl, jwt, auth.App.InstallationId)
+	}
+	// インストールトークンは1時間有効なので期限が近づくまで使い回す
+	return func() (string, error) {
+		return installationTokens.source(apiUrl, auth.App.InstallationId, fetch).token()
+	}
+}
+
+// PATは解決し直す。インストールトークンは期限まで使う
+func (auth *Auth) refresh() func() {
+	if auth.IsApp {
+		return nil
+	}
+	return auth.accessTokenCache.reset
+}
+
+// ランナーを登録する先のAPIのパス
+func (runner *Runner) scopePath() string {
+	if runner.Enterprise != "" {
+		return "/enterprises/" + runner.Enterprise
+	}
+	if runner.Repository == "" {
+		return "/orgs/" + runner.Owner
+	}
+	return "/repos/" + runner.Owner + "/" + runner.Repository
+}
+
+func (gh *GitHub) maxWait() time.Duration {
+	if gh.MaxWait > 0 {
+		return gh.MaxWait
+	}
+	return maxRateLimitWait
+}
+
+// プールのロックを持ったまま長く待たないクライアントにする
+func (gh *GitHub) forPool() *GitHub {
+	gh.MaxWait = maxPoolRateLimitWait
+	return gh
+}
+
+func (gh *GitHub) do(method, path string, body any, out any) error {
+	var data []byte
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		data = b
+	}
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		if err := gh.Limit.wait(gh.maxWait()); err != nil {
+			return fmt.Errorf("%s %s failed %s", method, path, err)
+		}
+		retry, err := gh.send(method, path, data, out)
+		// ローテーションされたトークンを解決し直して1回だけ送り直す
+		var apiErr *ApiError
+		if errors.As(err, &apiErr) && apiErr.Status == http.StatusUnauthorized && gh.Refresh != nil && !refreshed {
+			gh.Refresh()
+			refreshed = true
+			continue
+		}
+		if !retry || attempt == rateLimitRetries {
+			return err
+		}
+	}
+}
+
+// リクエストを1回送る。レート制限に掛かって再試行できる場合はtrueを返す
+func (gh *GitHub) send(method, path string, data []byte, out any) (bool, error) {
+	var reader io.Reader
+	if data != nil {
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, gh.ApiBase+path, reader)
+	if err != nil {
+		return false, err
+	}
+	token, err := gh.Token()
+	if err != nil {
+		return false, fmt.Errorf("Can not get token %s", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := gh.Client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("%s %s failed %s", method, path, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		limited := gh.Limit.update(res, string(msg))
+		return limited, &ApiError{Method: method, Path: path, Status: res.StatusCode, Body: string(bytes.TrimSpace(msg))}
+	}
+	gh.Limit.update(res, "")
+	if out == nil {
+		return false, nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return false, fmt.Errorf("can not decode %s %s", path, err)
+	}
+	return false, nil
+}
+
+func (gh *GitHub) listRunners(scope string) ([]GitHubRunner, error) {
+	runners := []GitHubRunner{}
+	for page := 1; ; page++ {
+		var body struct {
+			TotalCount int            `json:"total_count"`
+			Runners    []GitHubRunner `json:"runners"`
+		}
+		if err := gh.do(http.MethodGet, scope+"/actions/runners?per_page=100&page="+strconv.Itoa(page), nil, &body); err != nil {
+			return nil, err
+		}
+		runners = append(runners, body.Runners...)
+		if len(body.Runners) == 0 || len(runners) >= body.TotalCount {
+			return runners, nil
+		}
+	}
+}
+
+func (gh *GitHub) deleteRunner(scope string, id int) error {
+	return gh.do(http.MethodDelete, scope+"/actions/runners/"+strconv.Itoa(id), nil, nil)
+}
+
+// 全てのリポジトリが使えるDefaultグループ
+const defaultRunnerGroupId = 1
+
+type RunnerGroup struct {
+	Id         int    `json:"id"`
+	Name       string `json:"name"`
+	Visibility string `json:"visibility"`
+}
+
+func (gh *GitHub) listRunnerGroups(scope string) ([]RunnerGroup, error) {
+	groups := []RunnerGroup{}
+	for page := 1; ; page++ {
+		var body struct {
+			TotalCount   int           `json:"total_count"`
+			RunnerGroups []RunnerGroup `json:"runner_groups"`
+		}
+		if err := gh.do(http.MethodGet, scope+"/actions/runner-groups?per_page=100&page="+strconv.Itoa(page), nil, &body); err != nil {
+			return nil, err
+		}
+		groups = append(groups, body.RunnerGroups...)
+		if len(body.RunnerGroups) == 0 || len(groups) >= body.TotalCount {
+			return groups, nil
+		}
+	}
+}
+
+// ランナーグループがなければ作る。使えるリポジトリはGitHubで絞り込めるように最初は選択したリポジトリだけにする
+func (gh *GitHub) ensureRunnerGroup(scope, name string) (*RunnerGroup, error) {
+	groups, err := gh.listRunnerGroups(scope)
+	if err != nil {
+		return nil, fmt.Errorf("Can not get runner groups %s", err)
+	}
+	for _, g := range groups {
+		if g.Name == name {
+			return &g, nil
+		}
+	}
+	var group RunnerGroup
+	if err := gh.do(http.MethodPost, scope+"/actions/runner-groups", map[string]any{"name": name, "visibility": "selected"}, &group); err != nil {
+		return nil, fmt.Errorf("Can not create runner group %s %s", name, err)
+	}
+	log.Println("Created runner group", name, "select the repositories that can use it on GitHub")
+	return &group, nil
+}
+
+// 設定されたランナーグループを用意してJIT設定に使うIDを覚える
+func (config *Config) prepareRunnerGroup() error {
+	id := defaultRunnerGroupId
+	if config.Runner != nil && config.Runner.RunnerGroup != "" {
+		group, err := config.gitHub().ensureRunnerGroup(config.Runner.scopePath(), config.Runner.RunnerGroup)
+		if err != nil {
+			return err
+		}
+		id = group.Id
+	}
+	config.mu.Lock()
+	config.runnerGroupId = id
+	config.mu.Unlock()
+	return nil
+}
+
+type JitConfig struct {
+	Runner           GitHubRunner `json:"runner"`
+	EncodedJitConfig string       `json:"encoded_jit_config"`
+}
+
+// 1つのジョブだけを実行するランナーを登録してその設定を得る
+func (gh *GitHub) generateJitConfig(scope, name string, groupId int, labels []string) (*JitConfig, error) {
+	body := map[string]any{"name": name, "runner_group_id": groupId, "labels": labels, "work_folder": "_work"}
+	var jit JitConfig
+	if err := gh.do(http.MethodPost, scope+"/actions/runners/generate-jitconfig", body, &jit); err != nil {
+		return nil, err
+	}
+	return &jit, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestScopePath(t *testing.T) {
+	tests := []struct {
+		name  string
+		param *Runner
+		want  string
+	}{
+		{
+			name:  "organization",
+			param: &Runner{Owner: "owner"},
+			want:  "/orgs/owner",
+		},
+		{
+			name:  "repository",
+			param: &Runner{Owner: "owner", Repository: "repo"},
+			want:  "/repos/owner/repo",
+		},
+		{
+			name:  "enterprise",
+			param: &Runner{Enterprise: "slug"},
+			want:  "/enterprises/slug",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := tt.param.scopePath()
+
+			if actual != tt.want {
+				t.Errorf("scopePath() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}
+
+func TestListRunners(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Query().Get("page") {
+		case "1":
+			fmt.Fprint(w, `{"total_count": 2, "runners": [{"id": 1, "name": "local-runner-default-1", "status": "offline"}]}`)
+		case "2":
+			fmt.Fprint(w, `{"total_count": 2, "runners": [{"id": 2, "name": "local-runner-default-2", "status": "online", "busy": true}]}`)
+		}
+	}))
+	defer server.Close()
+
+	gh := &GitHub{ApiBase: server.URL, Token: func() (string, error) { return "token", nil }, Client: server.Client()}
+	actual, err := gh.listRunners("/repos/owner/repo")
+	if err != nil {
+		t.Fatalf("listRunners() error = %v", err)
+	}
+	if len(actual) != 2 || actual[0].Id != 1 || actual[1].Status != "online" || !actual[1].Busy {
+		t.Errorf("listRunners() = \n%v", actual)
+	}
+
+	gh.Token = func() (string, error) { return "invalid", nil }
+	_, err = gh.listRunners("/repos/owner/repo")
+	assert(t, "listRunners() error", err, fmt.Errorf("GET /repos/owner/repo/actions/runners?per_page=100&page=1 status: 401"))
+}
+
+func TestDeleteRunner(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.URL.Path != "/orgs/owner/actions/runners/1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	gh := &GitHub{ApiBase: server.URL, Token: func() (string, error) { return "token", nil }, Client: server.Client()}
+	if err := gh.deleteRunner("/orgs/owner", 1); err != nil {
+		t.Errorf("deleteRunner() error = %v", err)
+	}
+}
+
+func TestEnsureRunnerGroup(t *testing.T) {
+	created := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /orgs/owner/actions/runner-groups":
+			fmt.Fprint(w, `{"total_count": 2, "runner_groups": [{"id": 1, "name": "Default"}, {"id": 2, "name": "laptops", "visibility": "selected"}]}`)
+		case "POST /orgs/owner/actions/runner-groups":
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			created = append(created, body["name"]+" "+body["visibility"])
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id": 3, "name": "new", "visibility": "selected"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	gh := &GitHub{ApiBase: server.URL, Token: func() (string, error) { return "token", nil }, Client: server.Client()}
+	tests := []struct {
+		name    string
+		param   string
+		want    int
+		created []string
+	}{
+		{
+			name:    "exists",
+			param:   "laptops",
+			want:    2,
+			created: []string{},
+		},
+		{
+			name:    "create",
+			param:   "new",
+			want:    3,
+			created: []string{"new selected"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+			created = []string{}
+
+			actual, err := gh.ensureRunnerGroup("/orgs/owner", tt.param)
+
+			assert(t, "ensureRunnerGroup() error", err, nil)
+			if actual == nil || actual.Id != tt.want {
+				t.Errorf("ensureRunnerGroup() = \n%v, want id \n%v", actual, tt.want)
+			}
+			if !slices.Equal(created, tt.created) {
+				t.Errorf("ensureRunnerGroup() created = \n%v, want \n%v", created, tt.created)
+			}
+		})
+	}
+}
+
+func TestGitHubDoRefreshToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer new_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"total_count": 0, "runners": []}`)
+	}))
+	defer server.Close()
+	token := "old_token"
+	refreshed := 0
+	gh := &GitHub{ApiBase: server.URL, Token: func() (string, error) { return token, nil }, Refresh: func() { refreshed++; token = "new_token" }, Client: server.Client()}
+
+	if _, err := gh.listRunners("/orgs/owner"); err != nil {
+		t.Fatalf("listRunners() error = %v", err)
+	}
+
+	// 解決し直しても認証できなければ何度も解決しない
+	token = "invalid"
+	gh.Refresh = func() { refreshed++ }
+	_, err := gh.listRunners("/orgs/owner")
+	assert(t, "listRunners() error", err, fmt.Errorf("GET /orgs/owner/actions/runners?per_page=100&page=1 status: 401"))
+	if refreshed != 2 {
+		t.Errorf("listRunners() refreshed = \n%v, want \n%v", refreshed, 2)
+	}
+}
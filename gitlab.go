@@ -0,0 +1,229 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// GitLabにランナーを登録する先。group_idもproject_idもなければインスタンスのランナーになる
+type GitLab struct {
+	Url           string `json:"url" schema:"required"`
+	Token         string `json:"token" schema:"required"`
+	GroupId       int    `json:"group_id"`
+	ProjectId     int    `json:"project_id"`
+	RunnerVersion string `json:"runner_version"`
+
+	tokenCache SecretCache
+}
+
+type GitLabRunner struct {
+	Id          int    `json:"id"`
+	Description string `json:"description"`
+	Status      string `json:"status"`
+	Token       string `json:"token"`
+}
+
+const gitLabBackend = "gitlab"
+
+const defaultGitLabRunnerVersion = "17.7.0"
+
+// コンテナごとのランナー認証トークンを書き出すディレクトリ
+const gitLabTokenDir = "./gitlab-tokens"
+
+const gitLabStartScript = "gitlab-start.sh"
+
+// コンテナに登録したランナーのIDを付けるラベル
+const gitLabRunnerLabel = "local-runner.gitlab-runner"
+
+func (gitLab *GitLab) validate() error {
+	u, err := url.Parse(gitLab.Url)
+	if gitLab.Url == "" || err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("url is invalid %s", gitLab.Url)
+	}
+	if gitLab.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	if gitLab.GroupId != 0 && gitLab.ProjectId != 0 {
+		return fmt.Errorf("only one of group_id and project_id can be set")
+	}
+	return nil
+}
+
+func (gitLab *GitLab) setDefaultValue() {
+	gitLab.Url = strings.TrimSuffix(gitLab.Url, "/")
+	if gitLab.RunnerVersion == "" {
+		gitLab.RunnerVersion = defaultGitLabRunnerVersion
+	}
+}
+
+// ランナーを作るAPIに渡すrunner_typeとID
+func (gitLab *GitLab) runnerType() map[string]any {
+	switch {
+	case gitLab.ProjectId != 0:
+		return map[string]any{"runner_type": "project_type", "project_id": gitLab.ProjectId}
+	case gitLab.GroupId != 0:
+		return map[string]any{"runner_type": "group_type", "group_id": gitLab.GroupId}
+	default:
+		return map[string]any{"runner_type": "instance_type"}
+	}
+}
+
+// ランナーを一覧するAPIのパス
+func (gitLab *GitLab) runnersPath() string {
+	switch {
+	case gitLab.ProjectId != 0:
+		return "/projects/" + strconv.Itoa(gitLab.ProjectId) + "/runners"
+	case gitLab.GroupId != 0:
+		return "/groups/" + strconv.Itoa(gitLab.GroupId) + "/runners"
+	default:
+		return "/runners/all"
+	}
+}
+
+func (config *Config) gitLabApi() *GitHub {
+	return &GitHub{
+		ApiBase: config.GitLab.Url + "/api/v4",
+		Token:   config.GitLab.token,
+		Refresh: config.GitLab.tokenCache.reset,
+		Client:  config.HttpClient,
+		Limit:   rateLimits.get(config.GitLab.Url + "/api/v4"),
+	}
+}
+
+func (gitLab *GitLab) token() (string, error) {
+	return gitLab.tokenCache.get(gitLab.Token, "gitlab.token")
+}
+
+// ランナー認証トークンを発行する
+func (gh *GitHub) createGitLabRunner(body map[string]any) (*GitLabRunner, error) {
+	var runner GitLabRunner
+	if err := gh.do(http.MethodPost, "/user/runners", body, &runner); err != nil {
+		return nil, err
+	}
+	return &runner, nil
+}
+
+func (gh *GitHub) listGitLabRunners(path string) ([]GitLabRunner, error) {
+	runners := []GitLabRunner{}
+	for page := 1; ; page++ {
+		var list []GitLabRunner
+		if err := gh.do(http.MethodGet, path+"?per_page=100&page="+strconv.Itoa(page), nil, &list); err != nil {
+			return nil, err
+		}
+		if len(list) == 0 {
+			return runners, nil
+		}
+		runners = append(runners, list...)
+	}
+}
+
+func (gh *GitHub) deleteGitLabRunner(id int) error {
+	return gh.do(http.MethodDelete, "/runners/"+strconv.Itoa(id), nil, nil)
+}
+
+// gitlab-runner run-singleで1つのジョブを実行して終了するGitLabのランナー
+type GitLabBackend struct {
+	registrations Registrations
+}
+
+func (b *GitLabBackend) dockerfile(config *Config) string {
+	version := config.GitLab.RunnerVersion
+	return "\nRUN apt-get update && \\\n" +
+		"  apt-get install git -y && \\\n" +
+		"  rm -rf /var/lib/apt/lists/* && \\\n" +
+		"  case $(dpkg --print-architecture) in \\\n" +
+		"    armhf) arch=arm ;; \\\n" +
+		"    *) arch=$(dpkg --print-architecture) ;; \\\n" +
+		"  esac && \\\n" +
+		"  curl -fsSL -o /usr/local/bin/gitlab-runner https://gitlab-runner-downloads.s3.amazonaws.com/v" + version + "/binaries/gitlab-runner-linux-${arch} && \\\n" +
+		"  chmod +x /usr/local/bin/gitlab-runner\n" +
+		"\nCOPY " + gitLabStartScript + " /actions-runner/" + gitLabStartScript + "\n" +
+		"CMD [\"/bin/bash\", \"-c\", \"/actions-runner/" + gitLabStartScript + "\"]\n"
+}
+
+func (b *GitLabBackend) addTo(config *Config, tw *tar.Writer) error {
+	data, err := os.ReadFile(templateDir + "/" + gitLabStartScript)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", gitLabStartScript, err)
+	}
+	return addTarFile(tw, gitLabStartScript, data, 0755)
+}
+
+func (b *GitLabBackend) runnerName(pool *Pool) string {
+	return randomRunnerName(pool)
+}
+
+// コンテナごとにランナーを作り、その認証トークンをマウントする
+func (b *GitLabBackend) containerSpec(config *Config, pool *Pool, name string) (*ContainerSpec, error) {
+	body := config.GitLab.runnerType()
+	body["description"] = name
+	labels := config.poolLabels(pool)
+	body["tag_list"] = strings.Join(labels, ",")
+	body["run_untagged"] = len(labels) == 0
+	runner, err := config.gitLabApi().forPool().createGitLabRunner(body)
+	if err != nil {
+		return nil, fmt.Errorf("Can not create gitlab runner %s", err)
+	}
+	b.registrations.add(name, runner.Id)
+
+	if err := os.MkdirAll(gitLabTokenDir, 0700); err != nil {
+		return nil, fmt.Errorf("Can not create %s %s", gitLabTokenDir, err)
+	}
+	abspath, err := writeSecretFile(filepath.Join(gitLabTokenDir, name), []byte(runner.Token))
+	if err != nil {
+		return nil, fmt.Errorf("Can not create file %s", err)
+	}
+	return &ContainerSpec{
+		Env:    []string{"GITLAB_URL=" + config.GitLab.Url},
+		Binds:  []string{fmt.Sprintf("%s:%s:ro", abspath, "/mnt/runner-token.txt")},
+		Labels: map[string]string{gitLabRunnerLabel: strconv.Itoa(runner.Id)},
+	}, nil
+}
+
+// run-singleは終了させるとジョブを受け付けなくなる。登録はdieイベントで解除する
+func (b *GitLabBackend) stop(config *Config, c types.Container) error {
+	return config.Cli.ContainerStop(config.Ctx, c.ID, container.StopOptions{})
+}
+
+// 1つのジョブを実行して終了したランナーの登録を解除する
+func (b *GitLabBackend) exited(config *Config, name string, labels map[string]string) error {
+	id, ok := b.registrations.take(name, labels, gitLabRunnerLabel)
+	os.Remove(filepath.Join(gitLabTokenDir, name))
+	if !ok {
+		return nil
+	}
+	if err := config.gitLabApi().forPool().deleteGitLabRunner(id); err != nil {
+		return fmt.Errorf("Can not remove gitlab runner %s %s", name, err)
+	}
+	log.Println("Remove gitlab runner", name)
+	return nil
+}
+
+func (b *GitLabBackend) cleanup(config *Config) error {
+	api := config.gitLabApi()
+	runners, err := api.listGitLabRunners(config.GitLab.runnersPath())
+	if err != nil {
+		return fmt.Errorf("Can not get gitlab runners %s", err)
+	}
+	for _, r := range runners {
+		// never_contactedは起動中のコンテナのランナーかもしれないので残す
+		if (r.Status != "offline" && r.Status != "stale") || !strings.HasPrefix(r.Description, runnerNamePrefix) {
+			continue
+		}
+		log.Println("Remove gitlab runner", r.Description)
+		if err := api.deleteGitLabRunner(r.Id); err != nil {
+			log.Println("Can not remove gitlab runner", r.Description, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// GitLabのAPIの代わりに使うサーバー
+func fakeGitLab(t *testing.T, created *[]map[string]any, deleted *[]string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v4/user/runners", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		*created = append(*created, body)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id": 12, "token": "glrt-xxxx"}`)
+	})
+	mux.HandleFunc("GET /api/v4/groups/3/runners", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") != "1" {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		fmt.Fprint(w, `[
+			{"id": 1, "description": "local-runner-default-1", "status": "offline"},
+			{"id": 2, "description": "local-runner-default-2", "status": "online"},
+			{"id": 3, "description": "local-runner-default-3", "status": "never_contacted"},
+			{"id": 4, "description": "local-runner-default-4", "status": "stale"},
+			{"id": 5, "description": "other-runner", "status": "offline"}
+		]`)
+	})
+	mux.HandleFunc("DELETE /api/v4/runners/{id}", func(w http.ResponseWriter, r *http.Request) {
+		*deleted = append(*deleted, r.PathValue("id"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer glpat-xxxx" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGitLabRunnerType(t *testing.T) {
+	tests := []struct {
+		name  string
+		param *GitLab
+		want  string
+	}{
+		{
+			name:  "instance",
+			param: &GitLab{},
+			want:  `{"runner_type":"instance_type"} /runners/all`,
+		},
+		{
+			name:  "group",
+			param: &GitLab{GroupId: 3},
+			want:  `{"group_id":3,"runner_type":"group_type"} /groups/3/runners`,
+		},
+		{
+			name:  "project",
+			param: &GitLab{ProjectId: 7},
+			want:  `{"project_id":7,"runner_type":"project_type"} /projects/7/runners`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			body, _ := json.Marshal(tt.param.runnerType())
+			actual := string(body) + " " + tt.param.runnersPath()
+
+			if actual != tt.want {
+				t.Errorf("runnerType() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitLabContainerSpec(t *testing.T) {
+	created := []map[string]any{}
+	deleted := []string{}
+	server := fakeGitLab(t, &created, &deleted)
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	config := &Config{
+		GitLab:     &GitLab{Url: server.URL, Token: "glpat-xxxx", GroupId: 3},
+		Labels:     []string{"linux"},
+		HttpClient: server.Client(),
+	}
+	backend := &GitLabBackend{}
+	spec, err := backend.containerSpec(config, &Pool{Name: "default", Backend: gitLabBackend}, "local-runner-default-1")
+	assert(t, "containerSpec() error", err, nil)
+	if err != nil {
+		return
+	}
+
+	want := map[string]any{"runner_type": "group_type", "group_id": float64(3), "description": "local-runner-default-1", "tag_list": "linux", "run_untagged": false}
+	if len(created) != 1 || fmt.Sprint(created[0]) != fmt.Sprint(want) {
+		t.Errorf("containerSpec() created = \n%v, want \n%v", created, want)
+	}
+	if spec.Labels[gitLabRunnerLabel] != "12" {
+		t.Errorf("containerSpec() labels = \n%v, want \n%v", spec.Labels, "12")
+	}
+	data, err := os.ReadFile(filepath.Join(gitLabTokenDir, "local-runner-default-1"))
+	if err != nil || string(data) != "glrt-xxxx" {
+		t.Errorf("containerSpec() token = \n%s, want \n%s", data, "glrt-xxxx")
+	}
+
+	// ラベルを付ける前に失敗したコンテナも登録を解除する
+	err = backend.exited(config, "local-runner-default-1", map[string]string{})
+	assert(t, "exited() error", err, nil)
+	err = backend.exited(config, "local-runner-default-2", map[string]string{gitLabRunnerLabel: "13"})
+	assert(t, "exited() error", err, nil)
+	err = backend.exited(config, "local-runner-default-3", map[string]string{})
+	assert(t, "exited() error", err, nil)
+	if !slices.Equal(deleted, []string{"12", "13"}) {
+		t.Errorf("exited() deleted = \n%v, want \n%v", deleted, []string{"12", "13"})
+	}
+	if _, err := os.Stat(filepath.Join(gitLabTokenDir, "local-runner-default-1")); !os.IsNotExist(err) {
+		t.Errorf("exited() did not remove the token file")
+	}
+}
+
+func TestGitLabCleanup(t *testing.T) {
+	deleted := []string{}
+	server := fakeGitLab(t, &[]map[string]any{}, &deleted)
+	config := &Config{
+		GitLab:     &GitLab{Url: server.URL, Token: "glpat-xxxx", GroupId: 3},
+		HttpClient: server.Client(),
+	}
+
+	err := (&GitLabBackend{}).cleanup(config)
+
+	assert(t, "cleanup() error", err, nil)
+	if !slices.Equal(deleted, []string{"1", "4"}) {
+		t.Errorf("cleanup() deleted = \n%v, want \n%v", deleted, []string{"1", "4"})
+	}
+}
+
+func TestGitLabValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		param *GitLab
+		want  error
+	}{
+		{
+			name:  "valid",
+			param: &GitLab{Url: "https://gitlab.com", Token: "env:GITLAB_TOKEN", ProjectId: 1},
+			want:  nil,
+		},
+		{
+			name:  "invalid url",
+			param: &GitLab{Url: "gitlab.com", Token: "xxx"},
+			want:  fmt.Errorf("url is invalid gitlab.com"),
+		},
+		{
+			name:  "token is required",
+			param: &GitLab{Url: "https://gitlab.com"},
+			want:  fmt.Errorf("token is required"),
+		},
+		{
+			name:  "group and project",
+			param: &GitLab{Url: "https://gitlab.com", Token: "xxx", GroupId: 1, ProjectId: 1},
+			want:  fmt.Errorf("only one of group_id and project_id can be set"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := tt.param.validate()
+
+			assert(t, "gitLab.validate()", actual, tt.want)
+		})
+	}
+}
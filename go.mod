@@ -2,7 +2,12 @@ module github.com/tkmsaaaam/local-runner-controller
 
 go 1.23.1
 
-require github.com/docker/docker v27.4.1+incompatible
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/docker/docker v27.4.1+incompatible
+	go.etcd.io/bbolt v1.3.11
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/containerd/log v0.1.0 // indirect
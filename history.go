@@ -0,0 +1,293 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ランナーで実行したジョブの記録を保存する場所と期間
+type History struct {
+	Path          string `json:"path"`
+	RetentionDays int    `json:"retention_days"`
+
+	db *bolt.DB
+}
+
+const defaultHistoryPath = "./history.db"
+const defaultHistoryRetentionDays = 90
+
+var jobsBucket = []byte("jobs")
+
+// ジョブを実行したコンテナの記録
+type JobRecord struct {
+	Container  string    `json:"container"`
+	Pool       string    `json:"pool"`
+	Repository string    `json:"repository"`
+	Workflow   string    `json:"workflow"`
+	Job        string    `json:"job"`
+	RunUrl     string    `json:"run_url"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Result     string    `json:"result"`
+	ExitCode   int       `json:"exit_code"`
+	Usage      *Usage    `json:"usage,omitempty"`
+}
+
+// ジョブの開始時にランナーが実行するフック。ジョブの情報をコンテナ内のファイルに書き出す
+const jobStartedHook = `#!/bin/sh
+{
+  echo "GITHUB_SERVER_URL=$GITHUB_SERVER_URL"
+  echo "GITHUB_REPOSITORY=$GITHUB_REPOSITORY"
+  echo "GITHUB_WORKFLOW=$GITHUB_WORKFLOW"
+  echo "GITHUB_JOB=$GITHUB_JOB"
+  echo "GITHUB_RUN_ID=$GITHUB_RUN_ID"
+  echo "GITHUB_RUN_ATTEMPT=$GITHUB_RUN_ATTEMPT"
+  echo "STARTED_AT=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+} > ` + containerJobFile + `
+`
+
+const hooksDir = "./hooks"
+const jobStartedHookName = "job-started.sh"
+const containerHooksDir = "/mnt/local-runner-hooks"
+const containerJobFile = "/tmp/local-runner-job.env"
+
+// run.shが出力するジョブの結果
+var jobResultPattern = regexp.MustCompile(`Job (.+) completed with result: (\w+)`)
+
+func (history *History) validate() error {
+	if history.RetentionDays < 0 {
+		return fmt.Errorf("retention_days must not be negative")
+	}
+	return nil
+}
+
+func (history *History) setDefaultValue() {
+	if history.Path == "" {
+		history.Path = defaultHistoryPath
+	}
+	if history.RetentionDays == 0 {
+		history.RetentionDays = defaultHistoryRetentionDays
+	}
+}
+
+func (history *History) open(readOnly bool) error {
+	db, err := bolt.Open(history.Path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return fmt.Errorf("Can not open %s %s", history.Path, err)
+	}
+	history.db = db
+	if readOnly {
+		return nil
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	})
+}
+
+// 再読み込みした設定の履歴を開く。同じファイルなら開いたままのものを使う
+func (history *History) reopen(next *History) *History {
+	if history != nil && next != nil && history.Path == next.Path {
+		next.db = history.db
+		return next
+	}
+	history.close()
+	if next == nil {
+		return nil
+	}
+	if err := next.open(false); err != nil {
+		log.Println(err)
+		return nil
+	}
+	return next
+}
+
+func (history *History) close() {
+	if history != nil && history.db != nil {
+		history.db.Close()
+		history.db = nil
+	}
+}
+
+// 終了時刻とコンテナ名をキーにして時刻順に並べる
+func (history *History) add(record *JobRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	key := []byte(record.FinishedAt.UTC().Format(time.RFC3339Nano) + "/" + record.Container)
+	return history.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put(key, data)
+	})
+}
+
+// since以降に終了したジョブ
+func (history *History) list(since time.Time) ([]JobRecord, error) {
+	records := []JobRecord{}
+	err := history.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek([]byte(since.UTC().Format(time.RFC3339Nano))); k != nil; k, v = c.Next() {
+			var record JobRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("Invalid record %s %s", k, err)
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// 保存期間を過ぎた記録を削除する
+func (history *History) prune(now time.Time) {
+	if history == nil || history.db == nil {
+		return
+	}
+	limit := []byte(now.Add(-time.Duration(history.RetentionDays) * 24 * time.Hour).UTC().Format(time.RFC3339Nano))
+	err := history.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(jobsBucket).Cursor()
+		for k, _ := c.First(); k != nil && string(k) < string(limit); k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Can not remove old history", err)
+	}
+}
+
+// ジョブ開始のフックをコンテナに渡す環境変数とマウント
+func (history *History) hookSpec() ([]string, []string, error) {
+	if err := os.MkdirAll(hooksDir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("Can not create %s %s", hooksDir, err)
+	}
+	path := filepath.Join(hooksDir, jobStartedHookName)
+	if err := os.WriteFile(path, []byte(jobStartedHook), 0755); err != nil {
+		return nil, nil, fmt.Errorf("Can not create file %s %s", path, err)
+	}
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Can not get file path %s %s", path, err)
+	}
+	hook := containerHooksDir + "/" + jobStartedHookName
+	return []string{"ACTIONS_RUNNER_HOOK_JOB_STARTED=" + hook}, []string{abspath + ":" + hook + ":ro"}, nil
+}
+
+// 終了したコンテナからジョブの情報を読み出して記録する。ジョブを実行しなかったコンテナは記録しない
+func (config *Config) recordJob(id string, info types.ContainerJSON, exit *ContainerExit) {
+	if config.History == nil || config.History.db == nil {
+		return
+	}
+	reader, _, err := config.Cli.CopyFromContainer(config.Ctx, id, containerJobFile)
+	if err != nil {
+		// ジョブを実行しなかったコンテナにはファイルがない
+		if !errdefs.IsNotFound(err) {
+			log.Println("Can not get job of", exit.Name, err)
+		}
+		return
+	}
+	defer reader.Close()
+	env, err := readJobFile(reader)
+	if err != nil {
+		log.Println("Can not read job of", exit.Name, err)
+		return
+	}
+	record := newJobRecord(env, config.containerLogs(id, crashLogLines))
+	record.Container = exit.Name
+	record.ExitCode = exit.ExitCode
+	record.Usage = exit.Usage
+	if info.Config != nil {
+		record.Pool = info.Config.Labels[poolLabel]
+	}
+	record.FinishedAt = finishedAt(info.State, time.Now())
+	if err := config.History.add(record); err != nil {
+		log.Println("Can not record job of", exit.Name, err)
+	}
+	if usage := exit.Usage; usage != nil {
+		log.Printf("Job %s %s on %s used cpu: %.1fs memory: %s", record.Repository, record.Job, exit.Name, usage.CpuSeconds, formatBytes(usage.PeakMemory))
+	}
+}
+
+// コンテナの終了時刻。分からなければ一覧と削除の対象になるように今の時刻にする
+func finishedAt(state *types.ContainerState, now time.Time) time.Time {
+	if state == nil {
+		return now
+	}
+	finished, err := time.Parse(time.RFC3339Nano, state.FinishedAt)
+	if err != nil || finished.IsZero() {
+		return now
+	}
+	return finished
+}
+
+// CopyFromContainerが返すtarからジョブのファイルを読む
+func readJobFile(reader io.Reader) (map[string]string, error) {
+	tr := tar.NewReader(reader)
+	if _, err := tr.Next(); err != nil {
+		return nil, err
+	}
+	env := map[string]string{}
+	scanner := bufio.NewScanner(tr)
+	for scanner.Scan() {
+		if k, v, ok := strings.Cut(scanner.Text(), "="); ok {
+			env[k] = v
+		}
+	}
+	return env, scanner.Err()
+}
+
+func newJobRecord(env map[string]string, logs string) *JobRecord {
+	record := &JobRecord{
+		Repository: env["GITHUB_REPOSITORY"],
+		Workflow:   env["GITHUB_WORKFLOW"],
+		Job:        env["GITHUB_JOB"],
+	}
+	if env["GITHUB_RUN_ID"] != "" {
+		record.RunUrl = env["GITHUB_SERVER_URL"] + "/" + env["GITHUB_REPOSITORY"] + "/actions/runs/" + env["GITHUB_RUN_ID"]
+		if attempt := env["GITHUB_RUN_ATTEMPT"]; attempt != "" && attempt != "1" {
+			record.RunUrl += "/attempts/" + attempt
+		}
+	}
+	if started, err := time.Parse(time.RFC3339, env["STARTED_AT"]); err == nil {
+		record.StartedAt = started
+	}
+	if m := jobResultPattern.FindStringSubmatch(logs); m != nil {
+		// 表示名がある場合はGITHUB_JOBよりも分かりやすい
+		record.Job = m[1]
+		record.Result = m[2]
+	}
+	return record
+}
+
+func printHistory(w io.Writer, records []JobRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FINISHED\tDURATION\tREPOSITORY\tWORKFLOW\tJOB\tRESULT\tCONTAINER\tURL")
+	for _, r := range records {
+		duration := ""
+		if !r.StartedAt.IsZero() && !r.FinishedAt.IsZero() {
+			duration = r.FinishedAt.Sub(r.StartedAt).Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.FinishedAt.Local().Format(time.DateTime), duration, r.Repository, r.Workflow, r.Job, r.Result, r.Container, r.RunUrl)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestHistory(t *testing.T) {
+	history := &History{Path: filepath.Join(t.TempDir(), "history.db")}
+	history.setDefaultValue()
+	if err := history.open(false); err != nil {
+		t.Fatal(err)
+	}
+	defer history.close()
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	for i, finished := range []time.Time{now.Add(-100 * 24 * time.Hour), now.Add(-2 * time.Hour), now.Add(-time.Hour)} {
+		record := &JobRecord{Container: "local-runner-go-" + string(rune('1'+i)), FinishedAt: finished}
+		if err := history.add(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := history.list(now.Add(-90 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Container != "local-runner-go-3" {
+		t.Errorf("list() = \n%v", records)
+	}
+
+	history.prune(now)
+
+	records, err = history.list(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Container != "local-runner-go-2" {
+		t.Errorf("list() after prune() = \n%v", records)
+	}
+}
+
+func TestHistoryReopen(t *testing.T) {
+	dir := t.TempDir()
+	current := &History{Path: filepath.Join(dir, "history.db")}
+	if err := current.open(false); err != nil {
+		t.Fatal(err)
+	}
+
+	same := current.reopen(&History{Path: current.Path, RetentionDays: 1})
+	if same.db != current.db || same.RetentionDays != 1 {
+		t.Errorf("reopen() same path = \n%v", same)
+	}
+	moved := same.reopen(&History{Path: filepath.Join(dir, "moved.db")})
+	defer moved.close()
+	if moved.db == nil || same.db != nil {
+		t.Errorf("reopen() moved = \n%v", moved)
+	}
+	if disabled := (*History)(nil).reopen(nil); disabled != nil {
+		t.Errorf("reopen() disabled = \n%v", disabled)
+	}
+}
+
+func TestFinishedAt(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		param *types.ContainerState
+		want  time.Time
+	}{
+		{
+			name:  "finished",
+			param: &types.ContainerState{FinishedAt: "2024-01-01T10:00:00.5Z"},
+			want:  time.Date(2024, 1, 1, 10, 0, 0, 500000000, time.UTC),
+		},
+		{
+			name:  "no state",
+			param: nil,
+			want:  now,
+		},
+		{
+			name:  "zero time",
+			param: &types.ContainerState{FinishedAt: "0001-01-01T00:00:00Z"},
+			want:  now,
+		},
+		{
+			name:  "invalid",
+			param: &types.ContainerState{FinishedAt: ""},
+			want:  now,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := finishedAt(tt.param, now)
+
+			if !actual.Equal(tt.want) {
+				t.Errorf("finishedAt() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadJobFile(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	data := "GITHUB_REPOSITORY=owner/repo\nGITHUB_WORKFLOW=CI = build\n"
+	addTarFile(tw, "local-runner-job.env", []byte(data), 0644)
+	tw.Close()
+
+	env, err := readJobFile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if env["GITHUB_REPOSITORY"] != "owner/repo" || env["GITHUB_WORKFLOW"] != "CI = build" {
+		t.Errorf("readJobFile() = \n%v", env)
+	}
+}
+
+func TestNewJobRecord(t *testing.T) {
+	env := map[string]string{
+		"GITHUB_SERVER_URL":  "https://github.com",
+		"GITHUB_REPOSITORY":  "owner/repo",
+		"GITHUB_WORKFLOW":    "CI",
+		"GITHUB_JOB":         "test",
+		"GITHUB_RUN_ID":      "123",
+		"GITHUB_RUN_ATTEMPT": "2",
+		"STARTED_AT":         "2024-01-01T00:00:00Z",
+	}
+	logs := "2024-01-01 00:00:01Z: Running job: test (ubuntu)\n2024-01-01 00:01:00Z: Job test (ubuntu) completed with result: Failed"
+
+	actual := newJobRecord(env, logs)
+
+	want := JobRecord{Repository: "owner/repo", Workflow: "CI", Job: "test (ubuntu)", RunUrl: "https://github.com/owner/repo/actions/runs/123/attempts/2", StartedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Result: "Failed"}
+	if *actual != want {
+		t.Errorf("newJobRecord() = \n%v, want \n%v", *actual, want)
+	}
+}
+
+func TestPrintHistory(t *testing.T) {
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []JobRecord{{Container: "local-runner-go-1", Repository: "owner/repo", Workflow: "CI", Job: "test", Result: "Succeeded", StartedAt: started, FinishedAt: started.Add(90 * time.Second)}}
+	var buf bytes.Buffer
+
+	if err := printHistory(&buf, records); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "1m30s") || !strings.Contains(buf.String(), "owner/repo") {
+		t.Errorf("printHistory() = \n%v", buf.String())
+	}
+}
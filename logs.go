@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// コンテナのログを書き出す先と残す期間
+type Logs struct {
+	Dir           string `json:"dir"`
+	MaxSize       int    `json:"max_size"`
+	MaxFiles      int    `json:"max_files"`
+	RetentionDays int    `json:"retention_days"`
+	Stdout        bool   `json:"stdout"`
+}
+
+const defaultLogsDir = "./logs"
+const defaultLogMaxSize = 10
+const defaultLogMaxFiles = 3
+const defaultLogRetentionDays = 7
+
+// コンテナが終了してから削除するまでにログを書き終えるのを待つ時間
+const logFlushTimeout = 5 * time.Second
+
+func (logs *Logs) validate() error {
+	if logs.MaxSize < 0 || logs.MaxFiles < 0 || logs.RetentionDays < 0 {
+		return fmt.Errorf("max_size, max_files and retention_days must not be negative")
+	}
+	return nil
+}
+
+func (logs *Logs) setDefaultValue() {
+	if logs.Dir == "" && !logs.Stdout {
+		logs.Dir = defaultLogsDir
+	}
+	if logs.MaxSize == 0 {
+		logs.MaxSize = defaultLogMaxSize
+	}
+	if logs.MaxFiles == 0 {
+		logs.MaxFiles = defaultLogMaxFiles
+	}
+	if logs.RetentionDays == 0 {
+		logs.RetentionDays = defaultLogRetentionDays
+	}
+}
+
+// ログを書き出している途中のコンテナ
+type LogCaptures struct {
+	mu   sync.Mutex
+	done map[string]chan bool
+}
+
+var logCaptures = &LogCaptures{}
+
+func (c *LogCaptures) start(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done == nil {
+		c.done = map[string]chan bool{}
+	}
+	c.done[id] = make(chan bool)
+}
+
+func (c *LogCaptures) finish(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if done, ok := c.done[id]; ok {
+		close(done)
+		delete(c.done, id)
+	}
+}
+
+// コンテナのログを書き終えるまで待つ
+func (c *LogCaptures) wait(id string, timeout time.Duration) {
+	c.mu.Lock()
+	done, ok := c.done[id]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("Timed out writing logs of", id)
+	}
+}
+
+// 起動したコンテナのログを終了するまで書き出す
+func (config *Config) captureLogs(pool *Pool, id, name string) {
+	if config.Logs == nil {
+		return
+	}
+	logs := *config.Logs
+	logCaptures.start(id)
+	go func() {
+		defer logCaptures.finish(id)
+		writers := []io.Writer{}
+		if logs.Dir != "" {
+			f := &RotatingFile{Path: filepath.Join(logs.Dir, pool.Name, name+".log"), MaxSize: int64(logs.MaxSize) << 20, MaxFiles: logs.MaxFiles}
+			defer f.Close()
+			writers = append(writers, f)
+		}
+		if logs.Stdout {
+			w := &PrefixWriter{Prefix: "[" + name + "] "}
+			defer w.Flush()
+			writers = append(writers, w)
+		}
+		reader, err := config.Cli.ContainerLogs(config.Ctx, id, container.LogsOptions{ShowStdout: true, ShowStderr: true, Follow: true, Timestamps: true})
+		if err != nil {
+			log.Println("Can not get logs", name, err)
+			return
+		}
+		defer reader.Close()
+		w := io.MultiWriter(writers...)
+		if _, err := stdcopy.StdCopy(w, w, reader); err != nil {
+			log.Println("Can not read logs", name, err)
+		}
+	}()
+}
+
+// 一定の大きさを超えたら name.log.1, name.log.2 とずらして書き出すファイル
+type RotatingFile struct {
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+
+	file *os.File
+	size int64
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0700); err != nil {
+		return fmt.Errorf("Can not create %s %s", filepath.Dir(f.Path), err)
+	}
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Can not open %s %s", f.Path, err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, fi.Size()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	os.Remove(f.Path + "." + strconv.Itoa(f.MaxFiles))
+	for i := f.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(f.Path+"."+strconv.Itoa(i), f.Path+"."+strconv.Itoa(i+1))
+	}
+	if f.MaxFiles > 0 {
+		if err := os.Rename(f.Path, f.Path+".1"); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(f.Path)
+	}
+	return f.open()
+}
+
+func (f *RotatingFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// 1行ずつコンテナ名を付けてコントローラーのログに書き出す
+type PrefixWriter struct {
+	Prefix string
+	buf    []byte
+}
+
+func (w *PrefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		log.Print(w.Prefix + string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *PrefixWriter) Flush() {
+	if len(w.buf) > 0 {
+		log.Print(w.Prefix + string(w.buf))
+		w.buf = nil
+	}
+}
+
+// 保存期間を過ぎたログを削除する
+func (logs *Logs) prune(now time.Time) {
+	if logs == nil || logs.Dir == "" {
+		return
+	}
+	limit := now.Add(-time.Duration(logs.RetentionDays) * 24 * time.Hour)
+	filepath.Walk(logs.Dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.Contains(fi.Name(), ".log") {
+			return nil
+		}
+		if fi.ModTime().Before(limit) {
+			log.Println("Remove old log", path)
+			os.Remove(path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "go", "local-runner-go-1.log")
+	f := &RotatingFile{Path: path, MaxSize: 10, MaxFiles: 2}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != want {
+			t.Errorf("%s = \n%v, want \n%v %v", filepath.Base(name), string(data), want, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 is not removed", filepath.Base(path))
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFlags(log.LstdFlags)
+	w := &PrefixWriter{Prefix: "[local-runner-go-1] "}
+
+	w.Write([]byte("Connected to GitHub\nListening"))
+	w.Write([]byte(" for Jobs\nRunning"))
+	w.Flush()
+
+	want := "[local-runner-go-1] Connected to GitHub\n[local-runner-go-1] Listening for Jobs\n[local-runner-go-1] Running\n"
+	if buf.String() != want {
+		t.Errorf("PrefixWriter = \n%v, want \n%v", buf.String(), want)
+	}
+}
+
+func TestLogsPrune(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := filepath.Join(dir, "go", "local-runner-go-1.log")
+	rotated := filepath.Join(dir, "go", "local-runner-go-1.log.1")
+	recent := filepath.Join(dir, "go", "local-runner-go-2.log")
+	other := filepath.Join(dir, "notes.txt")
+	os.MkdirAll(filepath.Join(dir, "go"), 0700)
+	for _, p := range []string{old, rotated, recent, other} {
+		if err := os.WriteFile(p, []byte("log"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{old, rotated, other} {
+		os.Chtimes(p, now.Add(-8*24*time.Hour), now.Add(-8*24*time.Hour))
+	}
+	logs := &Logs{Dir: dir}
+	logs.setDefaultValue()
+
+	logs.prune(now)
+
+	for p, want := range map[string]bool{old: false, rotated: false, recent: true, other: true} {
+		if _, err := os.Stat(p); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", filepath.Base(p), err == nil, want)
+		}
+	}
+}
+
+func TestLogsSetDefaultValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		param *Logs
+		want  Logs
+	}{
+		{
+			name:  "empty",
+			param: &Logs{},
+			want:  Logs{Dir: "./logs", MaxSize: 10, MaxFiles: 3, RetentionDays: 7},
+		},
+		{
+			name:  "stdout only",
+			param: &Logs{Stdout: true, RetentionDays: 1},
+			want:  Logs{MaxSize: 10, MaxFiles: 3, RetentionDays: 1, Stdout: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			tt.param.setDefaultValue()
+
+			if *tt.param != tt.want {
+				t.Errorf("setDefaultValue() = \n%v, want \n%v", *tt.param, tt.want)
+			}
+		})
+	}
+}
@@ -4,19 +4,22 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
-	"strconv"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -26,19 +29,25 @@ import (
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 )
 
 type Runner struct {
-	ApiDomain  string `json:"api_domain"`
-	Domain     string `json:"domain"`
-	Owner      string `json:"owner"`
-	Repository string `json:"repository"`
-	Auth       *Auth  `json:"auth"`
+	ApiDomain   string `json:"api_domain"`
+	Domain      string `json:"domain"`
+	Enterprise  string `json:"enterprise"`
+	Owner       string `json:"owner"`
+	Repository  string `json:"repository"`
+	RunnerGroup string `json:"runner_group"`
+	Auth        *Auth  `json:"auth" schema:"required"`
+	CaBundle    string `json:"ca_bundle"`
 }
 type Auth struct {
 	IsApp       bool   `json:"is_app"`
 	AccessToken string `json:"access_token"`
-	App         App
+	App         App    `json:"app"`
+
+	accessTokenCache SecretCache
 }
 type App struct {
 	Id             int    `json:"id"`
@@ -47,66 +56,153 @@ type App struct {
 }
 
 type Env struct {
-	Runner         *Runner  `json:"runner"`
-	BaseImage      string   `json:"base_image"`
-	Limit          int      `json:"limit"`
-	Labels         []string `json:"labels"`
-	ContainerHost  string   `json:"container_host"`
-	ImageHost      string   `json:"image_host"`
-	RunnersVersion string   `json:"runners_version"`
+	Runner         *Runner           `json:"runner"`
+	Forgejo        *Forgejo          `json:"forgejo"`
+	GitLab         *GitLab           `json:"gitlab"`
+	Backend        string            `json:"backend"`
+	BaseImage      string            `json:"base_image"`
+	Limit          int               `json:"limit"`
+	Warm           int               `json:"warm"`
+	Labels         []string          `json:"labels"`
+	ContainerHost  string            `json:"container_host"`
+	ImageHost      string            `json:"image_host"`
+	RunnersVersion string            `json:"runners_version"`
+	Arch           string            `json:"arch"`
+	Dockerfile     string            `json:"dockerfile"`
+	BuildContext   string            `json:"build_context"`
+	BuildArgs      map[string]string `json:"build_args"`
+	Pools          []PoolEnv         `json:"pools"`
+	Offline        *Offline          `json:"offline"`
+	Proxy          *Proxy            `json:"proxy"`
+	Snapshot       *Snapshot         `json:"snapshot"`
+	Logs           *Logs             `json:"logs"`
+	History        *History          `json:"history"`
+	Layer
 }
 
 type Config struct {
-	Cli       *client.Client
-	Ctx       context.Context
-	Runner    *Runner
-	Limit     int
-	Labels    []string
-	BaseImage string
-	ImageHost string
-	Version   string
+	Cli           *client.Client
+	Ctx           context.Context
+	Runner        *Runner
+	Forgejo       *Forgejo
+	GitLab        *GitLab
+	Limit         int
+	Labels        []string
+	BaseImage     string
+	ImageHost     string
+	Version       string
+	Arch          string
+	Dockerfile    string
+	BuildContext  string
+	BuildArgs     map[string]string
+	BaseDigest    string
+	Layer         *Layer
+	Pools         []*Pool
+	Offline       *Offline
+	Proxy         *Proxy
+	Snapshot      *Snapshot
+	Logs          *Logs
+	History       *History
+	HttpClient    *http.Client
+	ContainerHost string
+	ConfigPath    string
+	// プールの状態を変更する時に使う
+	mu sync.Mutex
+	// イメージのビルドとコンテナの入れ替えはAPIと再読み込みから一つずつ行う
+	rollMu sync.Mutex
+	// JIT設定でランナーを登録するグループ
+	runnerGroupId int
+	// バックオフが終わった時にプールを確認し直すよう通知する
+	resyncChan chan<- bool
 }
 
 func (config *Config) imageName() string {
+	tag := config.BaseImage + "-" + config.Version
+	// 別アーキテクチャ向けのイメージはタグを分ける
+	if config.targetArch() != runtime.GOARCH {
+		tag += "-" + config.targetArch()
+	}
+	// Dockerfileやビルド引数を変えたら別のタグでビルドし直す
+	if config.BaseDigest != "" {
+		tag += "-" + config.BaseDigest
+	}
 	if config.ImageHost != "" {
-		return config.ImageHost + "/local-runner:" + config.BaseImage + "-" + config.Version
+		return config.ImageHost + "/local-runner:" + tag
 	}
-	return "local-runner:" + config.BaseImage + "-" + config.Version
+	return "local-runner:" + tag
 }
 
-const patPath = "./pat.txt"
-
-func main() {
-	p := os.Getenv("LOCAL_RUNNER_CONTROLLER_CONFIG_PATH")
-	if p == "" {
-		p = "config.json"
+// ベースイメージのビルドに使うDockerfile、ビルドコンテキスト、ビルド引数、レイヤーの内容のハッシュ
+func (config *Config) baseDigest() (string, error) {
+	dockerfile, err := config.baseDockerfile()
+	if err != nil {
+		return "", err
 	}
-	bytes, err := os.ReadFile(p)
+	layer, err := config.Layer.digest()
 	if err != nil {
-		log.Println("Config file (config.json) is not present.")
-		return
+		return "", err
 	}
-	config, err := makeConfig(bytes)
+	files, err := config.contextDigest()
 	if err != nil {
-		log.Println("Invalid enviroment variables: ", err)
-		return
+		return "", err
 	}
-	build, e := config.hasToBuild()
-	if e != nil {
-		log.Println("Can not find image: ", e)
-		return
+	return specHash(struct {
+		Dockerfile   string
+		BuildContext string
+		Context      string
+		BuildArgs    map[string]string
+		Layer        string
+		Offline      *Offline
+	}{string(dockerfile), config.BuildContext, files, config.BuildArgs, layer, config.Offline}), nil
+}
+
+const defaultRunnerVersion = "2.322.0"
+
+const templateDir = "./dockerfiles"
+
+// ビルドコンテキスト内で使う生成済みDockerfileの名前
+const buildDockerfile = "Dockerfile.local-runner"
+
+var reservedBuildArgs = []string{"arch", "os", "version", "sha256", "apt_proxy"}
+
+var packageNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9.+\-:=~]*$`)
+
+func main() {
+	cmd := "run"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd = args[0]
+		args = args[1:]
 	}
+	if err := runCommand(cmd, args); err != nil {
+		log.Fatalln(err)
+	}
+}
 
-	if build {
-		if er := config.buildRunnerImage(); er != nil {
-			log.Println("Can not build: ", er)
-			return
+func (config *Config) run() error {
+	if er := config.buildImages(false); er != nil {
+		return fmt.Errorf("Can not build: %s", er)
+	}
+	socket := socketPath(config.ConfigPath)
+	server, err := config.serveApi(socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+	defer server.Close()
+	if config.History != nil {
+		if err := config.History.open(false); err != nil {
+			return err
 		}
+		defer func() { config.History.close() }()
 	}
 	log.Println("Started")
+	if err := config.prepareRunnerGroup(); err != nil {
+		return err
+	}
+	config.removeExitedContainers()
 	if ee := config.handleContainer(); ee != nil {
-		log.Println(ee)
-		return
+		return *ee
 	}
 
 	// プログラム終了を制御するチャンネル
@@ -122,102 +218,158 @@ func main() {
 		done <- true // シグナルを受け取ったらdoneチャンネルに通知
 	}()
 
-	eventsChan, errorsChan := config.Cli.Events(config.Ctx, events.ListOptions{})
+	// SIGHUPまたは設定ファイルの変更で設定を読み直す
+	reloadChan := make(chan bool, 1)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			reloadChan <- true
+		}
+	}()
+	stopWatch := make(chan bool)
+	defer close(stopWatch)
+	go watchConfig(config.ConfigPath, watchInterval, reloadChan, stopWatch)
+
+	// イベントの購読が切れても再接続し、取りこぼしは定期的に確認して補う
+	eventsChan := make(chan events.Message)
+	resyncChan := make(chan bool, 1)
+	config.resyncChan = resyncChan
+	stopEvents := make(chan bool)
+	defer close(stopEvents)
+	go config.eventWatcher().watch(eventsChan, resyncChan, stopEvents)
+	resyncTicker := time.NewTicker(resyncInterval)
+	defer resyncTicker.Stop()
 
 	// イベントストリームの監視
 	for {
 		select {
 		case event := <-eventsChan:
 			if event.Type == events.ContainerEventType && event.Action == "die" {
-				if event.Actor.Attributes["image"] == config.imageName() {
+				if config.findPool(event.Actor.Attributes[poolLabel]) != nil {
 					log.Println("Container", event.Actor.ID, " has exited", event.Actor.Attributes)
+					name := event.Actor.Attributes["name"]
+					if err := backendOf(event.Actor.Attributes[backendLabel]).exited(config, name, runnerLabels(name, event.Actor.Attributes)); err != nil {
+						log.Println(err)
+					}
+					removeWarmFiles(name)
+					config.containerExited(event.Actor.ID, event.Actor.Attributes[poolLabel])
 					if ee := config.handleContainer(); ee != nil {
-						log.Println(ee)
-						return
+						log.Println(*ee)
 					}
 				}
 			}
-		case err := <-errorsChan:
-			log.Println("Error while listening to Docker events: ", err)
+		case <-resyncChan:
+			config.resync()
+		case <-resyncTicker.C:
+			config.resync()
+		case <-reloadChan:
+			if err := config.reload(); err != nil {
+				log.Println(err)
+			}
 		case <-done:
-			log.Println("Removing containers and ", patPath)
-			containers, err := config.Cli.ContainerList(config.Ctx, container.ListOptions{Filters: filters.NewArgs(filters.KeyValuePair{Key: "ancestor", Value: config.imageName()})})
+			log.Println("Removing containers and ", forgejoTokenDir, gitLabTokenDir, hooksDir)
+			containers, err := config.listAllContainers()
 			if err != nil {
-				log.Println("Can not remove containers", err)
-				return
+				return fmt.Errorf("Can not remove containers %s", err)
 			}
-			for _, v := range containers {
-				res, err := config.Cli.ContainerExecCreate(config.Ctx, v.ID, container.ExecOptions{
-					Cmd: []string{"/bin/bash", "-c", "/actions-runner/stop.sh"},
-				})
-				if err != nil {
-					log.Println("Can not remove container ContainerExecCreate ", err)
-					continue
-				}
-				var attachResp types.HijackedResponse
-				attachResp, err = config.Cli.ContainerExecAttach(config.Ctx, res.ID, container.ExecStartOptions{})
-				if err != nil {
-					log.Println("Can not remove container ContainerExecAttach", err)
-					continue
-				}
-				defer attachResp.Close()
-				// 標準出力を読み取り
-				go func() {
-					if _, err := io.Copy(log.Writer(), attachResp.Reader); err != nil {
-						log.Printf("Error reading attached exec output: %s", err)
-					}
-				}()
-
-				// `exec`プロセスが終了するのを待つ
-				for {
-					// `ContainerExecInspect`で`exec`プロセスの状態を確認
-					execInspect, err := config.Cli.ContainerExecInspect(context.Background(), res.ID)
-					if err != nil {
-						log.Fatalf("Error inspecting exec instance: %s", err)
-					}
-
-					// 終了したかを確認
-					if execInspect.Running == false {
-						fmt.Printf("Exec process finished with exit code: %d\n", execInspect.ExitCode)
-						break
+			config.stopContainers(containers)
+			for _, path := range []string{forgejoTokenDir, gitLabTokenDir, hooksDir} {
+				if _, err := os.Stat(path); err == nil {
+					log.Println("Remove", path)
+					if e := os.RemoveAll(path); e != nil {
+						log.Println("Can not remove ", path, " ", e)
 					}
-
-					// 少し待ってから再度確認
-					time.Sleep(500 * time.Millisecond)
-				}
-				log.Println("Remove container id: ", v.ID)
-			}
-			if _, err := os.Stat(patPath); !os.IsExist(err) {
-				log.Println("Remove", patPath)
-				if e := os.Remove(patPath); e != nil {
-					log.Println("Can not remove ", patPath, " ", e)
 				}
 			}
-			return
+			return nil
+		}
+	}
+}
+
+func (config *Config) listAllContainers() ([]types.Container, error) {
+	containers := []types.Container{}
+	for _, pool := range config.poolList() {
+		list, err := config.listContainers(pool)
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, list...)
+	}
+	return containers, nil
+}
+
+// ランナーの登録を解除してコンテナを終了させる
+func (config *Config) stopContainers(containers []types.Container) {
+	for _, v := range containers {
+		v.Labels = runnerLabels(containerName(v), v.Labels)
+		if err := backendOf(v.Labels[backendLabel]).stop(config, v); err != nil {
+			log.Println(err)
+			continue
 		}
+		log.Println("Remove container id: ", v.ID)
+		if err := config.Cli.ContainerRemove(config.Ctx, v.ID, container.RemoveOptions{Force: true}); err != nil && !errdefs.IsNotFound(err) {
+			log.Println("Can not remove container", v.ID, err)
+		}
+		usageSamplers.drop(v.ID)
 	}
 }
 
 func makeConfig(bytes []byte) (*Config, error) {
-	var env Env
-	if err := json.Unmarshal(bytes, &env); err != nil {
-		return nil, fmt.Errorf("Config file (config.json) is invalid.")
+	config, err := parseConfig(bytes)
+	if err != nil {
+		return nil, err
 	}
 
-	if gitHubError := env.Runner.validate(); gitHubError != nil {
-		return nil, fmt.Errorf("Runner is not valid in config.json %s", gitHubError)
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithHost(config.ContainerHost))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Docker client: %s", err)
 	}
+	config.Cli = cli
 
-	env.Runner.setDefaultValue()
+	httpClient, err := newHttpClient(config.caBundle(), config.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	config.HttpClient = httpClient
 
-	var containerHost = "unix:///var/run/docker.sock"
-	if env.ContainerHost != "" {
-		containerHost = env.ContainerHost
+	// 参照で指定された秘密情報を解決できなければ起動しない
+	if config.Runner != nil {
+		if err := config.Runner.Auth.resolve(); err != nil {
+			return nil, fmt.Errorf("Runner is not valid in config.json %s", err)
+		}
+	}
+	if config.Forgejo != nil {
+		if _, err := config.Forgejo.token(); err != nil {
+			return nil, fmt.Errorf("Forgejo is not valid in config.json %s", err)
+		}
+	}
+	if config.GitLab != nil {
+		if _, err := config.GitLab.token(); err != nil {
+			return nil, fmt.Errorf("GitLab is not valid in config.json %s", err)
+		}
+	}
+
+	// 指定されたバージョンがリリースされていなければデフォルトのバージョンを使う
+	// オフラインではリリースを確認できないのでartifacts_dirのtarballを信じる
+	if config.Version != defaultRunnerVersion && config.Offline == nil {
+		res, err := config.HttpClient.Get("https://github.com/actions/runner/releases/tag/v" + config.Version)
+		if err != nil || res.StatusCode != http.StatusOK {
+			config.Version = defaultRunnerVersion
+		}
+		if err == nil {
+			res.Body.Close()
+		}
 	}
 
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithHost(containerHost))
+	return config, nil
+}
+
+// Dockerに接続せずに設定を読み込んで検証する
+func parseConfig(bytes []byte) (*Config, error) {
+	env, err := decodeEnv(bytes)
 	if err != nil {
-		return nil, fmt.Errorf("Error creating Docker client: %s", err)
+		return nil, fmt.Errorf("Config file (config.json) is invalid. %w", err)
 	}
 
 	var limit = env.Limit
@@ -225,14 +377,110 @@ func makeConfig(bytes []byte) (*Config, error) {
 		limit = 2
 	}
 
+	pools, err := makePools(env, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// プールが使うバックエンドの設定だけを必須にする
+	for _, pool := range pools {
+		switch pool.backendName() {
+		case gitHubBackend:
+			if env.Runner == nil {
+				return nil, fmt.Errorf("Runner is not valid in config.json runner is required")
+			}
+		case forgejoBackend:
+			if env.Forgejo == nil {
+				return nil, fmt.Errorf("Forgejo is not valid in config.json forgejo is required by pool %s", pool.Name)
+			}
+			// ラベルがないとact_runnerはジョブをDockerで動かす既定のラベルで登録する
+			if len(env.Labels) == 0 && len(pool.Labels) == 0 {
+				return nil, fmt.Errorf("labels are required by pool %s of forgejo", pool.Name)
+			}
+		case gitLabBackend:
+			if env.GitLab == nil {
+				return nil, fmt.Errorf("GitLab is not valid in config.json gitlab is required by pool %s", pool.Name)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown backend %s of pool %s", pool.Backend, pool.Name)
+		}
+		// GitHub以外のランナーはイメージのビルド中にダウンロードする
+		if pool.backendName() != gitHubBackend && env.Offline != nil {
+			return nil, fmt.Errorf("pool %s can not use %s offline", pool.Name, pool.backendName())
+		}
+	}
+	if env.Runner != nil {
+		if gitHubError := env.Runner.validate(); gitHubError != nil {
+			return nil, fmt.Errorf("Runner is not valid in config.json %s", gitHubError)
+		}
+		env.Runner.setDefaultValue()
+	}
+	if env.Forgejo != nil {
+		if err := env.Forgejo.validate(); err != nil {
+			return nil, fmt.Errorf("Forgejo is not valid in config.json %s", err)
+		}
+		env.Forgejo.setDefaultValue()
+	}
+	if env.GitLab != nil {
+		if err := env.GitLab.validate(); err != nil {
+			return nil, fmt.Errorf("GitLab is not valid in config.json %s", err)
+		}
+		env.GitLab.setDefaultValue()
+	}
+
+	var containerHost = "unix:///var/run/docker.sock"
+	if env.ContainerHost != "" {
+		containerHost = env.ContainerHost
+	}
+
 	var baseImage = "Jammy"
-	if env.BaseImage != "" {
-		if _, err := os.Stat("./dockerfiles/Dockerfile" + env.BaseImage); os.IsNotExist(err) {
-			return nil, fmt.Errorf("Can not find ./dockerfiles/Dockerfile%s", env.BaseImage)
+	dockerfile := ""
+	buildContext := templateDir
+	if env.Dockerfile != "" {
+		if _, err := os.Stat(env.Dockerfile); os.IsNotExist(err) {
+			return nil, fmt.Errorf("Can not find %s", env.Dockerfile)
+		}
+		dockerfile = env.Dockerfile
+		buildContext = filepath.Dir(env.Dockerfile)
+		baseImage = "Custom"
+		if env.BaseImage != "" {
+			baseImage = env.BaseImage
+		}
+	} else if env.BaseImage != "" {
+		if _, err := os.Stat(templateDir + "/Dockerfile" + env.BaseImage); os.IsNotExist(err) {
+			return nil, fmt.Errorf("Can not find %s/Dockerfile%s", templateDir, env.BaseImage)
 		}
 		baseImage = env.BaseImage
 	}
 
+	if env.BuildContext != "" {
+		if env.Dockerfile == "" {
+			return nil, fmt.Errorf("build_context requires dockerfile")
+		}
+		if fi, err := os.Stat(env.BuildContext); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("Can not find build context %s", env.BuildContext)
+		}
+		buildContext = env.BuildContext
+	}
+
+	for k := range env.BuildArgs {
+		if slices.Contains(reservedBuildArgs, k) {
+			return nil, fmt.Errorf("build_args.%s is reserved", k)
+		}
+	}
+
+	if err := env.Layer.validate(); err != nil {
+		return nil, err
+	}
+
+	if env.Arch != "" {
+		if _, err := runnerArch(env.Arch); err != nil {
+			return nil, err
+		}
+	} else if _, err := runnerArch(runtime.GOARCH); err != nil {
+		return nil, fmt.Errorf("%s, set arch in config.json", err)
+	}
+
 	host := ""
 	if env.ImageHost != "" {
 		_, err := url.Parse(env.ImageHost)
@@ -242,33 +490,86 @@ func makeConfig(bytes []byte) (*Config, error) {
 		host = env.ImageHost
 	}
 
-	version := "2.322.0"
-	if env.RunnersVersion != "" {
-		res, err := http.Get("https://github.com/actions/runner/releases/tag/v" + env.RunnersVersion)
-		if err == nil && res.StatusCode == http.StatusOK {
-			version = env.RunnersVersion
+	if env.Offline != nil {
+		if err := env.Offline.validate(); err != nil {
+			return nil, fmt.Errorf("offline is invalid %s", err)
+		}
+	}
+
+	if env.Proxy != nil {
+		if err := env.Proxy.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if env.Snapshot != nil {
+		if err := env.Snapshot.validate(); err != nil {
+			return nil, fmt.Errorf("snapshot is invalid %s", err)
+		}
+	}
+
+	if env.Logs != nil {
+		if err := env.Logs.validate(); err != nil {
+			return nil, fmt.Errorf("logs is invalid %s", err)
+		}
+		env.Logs.setDefaultValue()
+	}
+
+	if env.History != nil {
+		if err := env.History.validate(); err != nil {
+			return nil, fmt.Errorf("history is invalid %s", err)
 		}
-		defer res.Body.Close()
+		env.History.setDefaultValue()
+	}
+
+	version := defaultRunnerVersion
+	if env.RunnersVersion != "" {
+		version = env.RunnersVersion
 	}
 
 	config := &Config{
-		Cli:       cli,
-		Ctx:       context.Background(),
-		Runner:    env.Runner,
-		Limit:     limit,
-		Labels:    env.Labels,
-		BaseImage: baseImage,
-		ImageHost: host,
-		Version:   version,
+		Ctx:           context.Background(),
+		Runner:        env.Runner,
+		Forgejo:       env.Forgejo,
+		GitLab:        env.GitLab,
+		Limit:         limit,
+		Labels:        env.Labels,
+		BaseImage:     baseImage,
+		ImageHost:     host,
+		Version:       version,
+		Arch:          env.Arch,
+		Dockerfile:    dockerfile,
+		BuildContext:  buildContext,
+		BuildArgs:     env.BuildArgs,
+		Layer:         &env.Layer,
+		Pools:         pools,
+		Offline:       env.Offline,
+		Proxy:         env.Proxy,
+		Snapshot:      env.Snapshot,
+		Logs:          env.Logs,
+		History:       env.History,
+		ContainerHost: containerHost,
+	}
+	config.BaseDigest, err = config.baseDigest()
+	if err != nil {
+		return nil, err
 	}
 
 	return config, nil
 }
 
 func (runner *Runner) validate() error {
-	if runner.Owner == "" {
+	if runner.Enterprise != "" {
+		if runner.Owner != "" || runner.Repository != "" {
+			return fmt.Errorf("owner and repository can not be set with enterprise")
+		}
+	} else if runner.Owner == "" {
 		return fmt.Errorf("owner is required")
 	}
+	// ランナーグループはリポジトリのランナーには使えない
+	if runner.RunnerGroup != "" && runner.Repository != "" {
+		return fmt.Errorf("runner_group can not be set with repository")
+	}
 
 	if runner.Auth == nil {
 		return fmt.Errorf("auth is required")
@@ -277,16 +578,30 @@ func (runner *Runner) validate() error {
 	if authError := runner.Auth.validate(); authError != nil {
 		return fmt.Errorf("auth is invalid %s", authError)
 	}
+	// GitHub Appはエンタープライズのランナーを登録できない
+	if runner.Enterprise != "" && runner.Auth.IsApp {
+		return fmt.Errorf("enterprise requires access_token")
+	}
+
+	if runner.CaBundle != "" {
+		if _, err := readCaBundle(runner.CaBundle); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (runner *Runner) setDefaultValue() {
-	if runner.ApiDomain == "" {
-		runner.ApiDomain = "api.github.com"
-	}
 	if runner.Domain == "" {
 		runner.Domain = "github.com"
 	}
+	if runner.ApiDomain == "" {
+		// GitHub Enterprise ServerのAPIは同じドメインにある
+		runner.ApiDomain = "api.github.com"
+		if runner.Domain != "github.com" {
+			runner.ApiDomain = runner.Domain
+		}
+	}
 }
 
 func (auth *Auth) validate() error {
@@ -310,103 +625,184 @@ func (auth *Auth) validate() error {
 
 // コンテナ終了時のコールバック処理
 func (config *Config) handleContainer() *error {
-	// 必要な処理をここに実装
-	containers, err := config.Cli.ContainerList(config.Ctx, container.ListOptions{Filters: filters.NewArgs(filters.KeyValuePair{Key: "ancestor", Value: config.imageName()})})
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	for _, pool := range config.Pools {
+		if err := config.handlePool(pool); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (config *Config) listContainers(pool *Pool) ([]types.Container, error) {
+	list, err := config.Cli.ContainerList(config.Ctx, container.ListOptions{Filters: filters.NewArgs(filters.KeyValuePair{Key: "label", Value: poolLabel + "=" + pool.Name})})
+	if err != nil {
+		return nil, err
+	}
+	// 登録の設定を待っているだけのコンテナはランナーとして数えない
+	containers := []types.Container{}
+	for _, c := range list {
+		if !warmIdle(c) {
+			containers = append(containers, c)
+		}
+	}
+	return containers, nil
+}
+
+// プールのコンテナ数を上限まで増やす
+func (config *Config) handlePool(pool *Pool) *error {
+	if pool.Paused || time.Now().Before(pool.BackoffUntil) {
+		return nil
+	}
+	containers, err := config.listContainers(pool)
 	if err != nil {
 		log.Println("Can not get containers list")
 		res := fmt.Errorf("Can not get containers list %s", err)
 		return &res
 	}
-	if len(containers) >= config.Limit {
-		return nil
+	backend := config.backend(pool)
+	warm, err := config.warmContainers(pool)
+	if err != nil {
+		res := fmt.Errorf("Can not get containers list %s", err)
+		return &res
+	}
+	// 作成済みのコンテナがあれば先に起動する
+	for i := len(containers); i < pool.Limit; i++ {
+		var name string
+		var started *types.Container
+		if len(warm) > 0 {
+			started = &warm[0]
+			warm = warm[1:]
+			name = containerName(*started)
+			err = config.startWarmContainer(pool, backend, *started)
+		} else {
+			name = backend.runnerName(pool)
+			err = config.createContainer(pool, backend, name)
+		}
+		if err != nil {
+			log.Println("Error creating container: ", err)
+			// 登録だけ残らないようにする
+			if err := backend.exited(config, name, map[string]string{}); err != nil {
+				log.Println(err)
+			}
+			// 登録できない間はプール全体を待たせ、他のプールは続ける
+			var spec *SpecError
+			if errors.As(err, &spec) {
+				config.resyncAfter(pool.recordFailure(spec.Err, time.Now()))
+				return nil
+			}
+			if started != nil {
+				config.removeWarmContainer(*started)
+			}
+		}
 	}
-	j := config.Limit - len(containers)
+	config.fillWarmPool(pool, backend, warm)
+	return nil
+}
+
+// コンテナの設定を用意できなかったエラー。作成や起動の失敗と違ってプール全体の問題
+type SpecError struct {
+	Err error
+}
+
+func (e *SpecError) Error() string {
+	return e.Err.Error()
+}
+
+func (config *Config) createContainer(pool *Pool, backend Backend, name string) error {
 	// コンテナの設定
-	var env = []string{"GITHUB_API_DOMAIN=" + config.Runner.ApiDomain, "GITHUB_DOMAIN=" + config.Runner.Domain, "RUNNER_ALLOW_RUNASROOT=abc"}
-	labels := map[string]string{}
-	if config.Runner.Repository == "" {
-		labels["owner"] = config.Runner.Owner
-		env = append(env, "GITHUB_REPOSITORY_OWNER="+config.Runner.Owner, "LABELS="+strings.Join(config.Labels, ","))
-	} else {
-		labels["owner"] = config.Runner.Owner
-		labels["repository"] = config.Runner.Repository
-		env = append(env, "GITHUB_REPOSITORY_OWNER="+config.Runner.Owner, "GITHUB_REPOSITORY_NAME="+config.Runner.Repository, "LABELS="+strings.Join(config.Labels, ","))
+	spec, err := backend.containerSpec(config, pool, name)
+	if err != nil {
+		return &SpecError{Err: err}
+	}
+	id, err := config.newContainer(pool, name, spec)
+	if err != nil {
+		return err
 	}
 
-	var binds []string
-	if config.Runner.Auth.IsApp {
-		env = append(env, "APP_ID="+strconv.Itoa(config.Runner.Auth.App.Id), "INSTALL_ID="+strconv.Itoa(config.Runner.Auth.App.InstallationId), "KEY_FILE_PATH=/mnt/private-key.pem")
-		binds = []string{
-			fmt.Sprintf("%s:%s:ro", config.Runner.Auth.App.KeyPath, "/mnt/private-key.pem"), // roはリードオンリー
-		}
-	} else {
-		patFile, err := os.Create(patPath)
-		if err != nil {
-			log.Println("Can not create file", patPath)
-			res := fmt.Errorf("Can not create file %s %s", patPath, err)
-			return &res
+	// コンテナを起動
+	if err := config.Cli.ContainerStart(config.Ctx, id, container.StartOptions{}); err != nil {
+		// 起動できなかったコンテナは作成されたまま残らないように消す
+		if err := config.Cli.ContainerRemove(config.Ctx, id, container.RemoveOptions{Force: true}); err != nil {
+			log.Println("Can not remove container", id, err)
 		}
+		return fmt.Errorf("Error starting container: %s", err)
+	}
+	config.captureLogs(pool, id, name)
+	config.sampleUsage(id)
+	return nil
+}
 
-		patFile.Write([]byte(config.Runner.Auth.AccessToken))
-		abspath, err := filepath.Abs(patFile.Name())
+// プロキシと証明書のためにどのコンテナにも渡す環境変数とマウント
+func (config *Config) runtimeEnv() ([]string, []string, error) {
+	env := config.Proxy.env()
+	binds := []string{}
+	if caBundle := config.caBundle(); caBundle != "" {
+		abspath, err := filepath.Abs(caBundle)
 		if err != nil {
-			log.Println("Can not get file path", patPath)
-			res := fmt.Errorf("Can not get file path %s %s", patPath, err)
-			return &res
-		}
-		binds = []string{
-			fmt.Sprintf("%s:%s:ro", abspath, "/mnt/pat.txt"), // roはリードオンリー
+			return nil, nil, fmt.Errorf("Can not get file path %s %s", caBundle, err)
 		}
+		// Node.jsのアクションはシステムの証明書ストアを読まない
+		env = append(env, "NODE_EXTRA_CA_CERTS="+containerCaBundle)
+		binds = append(binds, fmt.Sprintf("%s:%s:ro", abspath, containerCaBundle))
+	}
+	return env, binds, nil
+}
+
+// 起動せずにコンテナを作成してIDを返す
+func (config *Config) newContainer(pool *Pool, name string, spec *ContainerSpec) (string, error) {
+	labels := map[string]string{poolLabel: pool.Name, specLabel: config.poolSpec(pool), backendLabel: pool.backendName()}
+	for k, v := range spec.Labels {
+		labels[k] = v
+	}
+	env, binds, err := config.runtimeEnv()
+	if err != nil {
+		return "", &SpecError{Err: err}
 	}
+	env = append(spec.Env, env...)
+	binds = append(spec.Binds, binds...)
 
 	containerConfig := &container.Config{
-		Image:  config.imageName(),
+		Image:  config.containerImage(pool),
 		Env:    env,
 		Labels: labels,
+		// ランナー名はホスト名になるのでコンテナ名と揃える
+		Hostname: name,
 	}
 
 	// ホスト設定（自動削除など）
 	hostConfig := &container.HostConfig{
-		AutoRemove: true, // コンテナ終了後に自動で削除
+		// 終了コードとログを確認してから削除する
+		AutoRemove: false,
 		Binds:      binds,
 	}
 
-	for i := 0; i < j; i++ {
-		seed := time.Now().UnixNano()
-		rand.New(rand.NewSource(seed))
-		val := rand.Intn(100000)
-
-		// コンテナの作成
-		resp, err := config.Cli.ContainerCreate(
-			config.Ctx,
-			containerConfig,
-			hostConfig,
-			nil,
-			nil,
-			"local-runner-"+strconv.Itoa(val),
-		)
-
-		if err != nil {
-			log.Println("Error creating container: ", err)
-			continue
-		}
-
-		// コンテナのIDを表示
-		log.Println("Container created with ID: ", resp.ID)
-
-		// コンテナを起動
-		if err := config.Cli.ContainerStart(config.Ctx, resp.ID, container.StartOptions{}); err != nil {
-			log.Println("Error starting container: ", err)
-			continue
-		}
+	// コンテナの作成
+	resp, err := config.Cli.ContainerCreate(
+		config.Ctx,
+		containerConfig,
+		hostConfig,
+		nil,
+		nil,
+		name,
+	)
+	if err != nil {
+		return "", err
 	}
-	return nil
+
+	// コンテナのIDを表示
+	log.Println("Container created with ID: ", resp.ID)
+	return resp.ID, nil
 }
 
 func (config *Config) buildRunnerImage() error {
 	// イメージビルドオプションの設定
 	args := map[string]*string{}
-	arch := runtime.GOARCH
+	arch, err := runnerArch(config.targetArch())
+	if err != nil {
+		return err
+	}
 	goos := runtime.GOOS
 	if goos == "darwin" {
 		goos = "linux"
@@ -416,22 +812,54 @@ func (config *Config) buildRunnerImage() error {
 	if config.Version != "" {
 		args["version"] = &config.Version
 	}
-	for k, v := range args {
-		log.Println(k, *v)
+	var sha string
+	if config.Offline != nil {
+		if err := config.checkArtifacts(); err != nil {
+			return err
+		}
+		tarball, err := config.runnerTarball()
+		if err != nil {
+			return err
+		}
+		sha, err = readChecksumFile(filepath.Join(config.Offline.ArtifactsDir, tarball+".sha256"))
+		if err != nil {
+			return fmt.Errorf("Can not get checksum of runner: %s", err)
+		}
+		if config.Offline.AptProxy != "" {
+			args["apt_proxy"] = &config.Offline.AptProxy
+		}
+	} else {
+		// ダウンロードしたtarballをリリースノートのSHA256で検証する
+		sha, err = fetchRunnerChecksum(config.HttpClient, runnerReleaseApi+config.Version, goos+"-"+arch)
+		if err != nil {
+			return fmt.Errorf("Can not get checksum of runner: %s", err)
+		}
+	}
+	args["sha256"] = &sha
+	for k, v := range config.BuildArgs {
+		args[k] = &v
+	}
+	// 値にはトークンやプロキシの認証情報が入ることがあるのでキーだけ表示する
+	for k := range args {
+		log.Println("Build arg", k)
 	}
 	options := types.ImageBuildOptions{
 		Tags:       []string{config.imageName()},
-		Dockerfile: "Dockerfile" + config.BaseImage,
+		Dockerfile: buildDockerfile,
 		Remove:     true,
 		BuildArgs:  args,
-		Platform:   goos + "/" + arch,
+		Platform:   config.platform(),
 	}
 
-	buildContext, err := config.createBuildContext("./dockerfiles")
+	buildContext, err := config.createBuildContext(config.BuildContext)
 	if err != nil {
 		return fmt.Errorf("Error creating build context: %s", err)
 	}
 
+	return config.runImageBuild(buildContext, options)
+}
+
+func (config *Config) runImageBuild(buildContext io.Reader, options types.ImageBuildOptions) error {
 	res, er := config.Cli.ImageBuild(config.Ctx, buildContext, options)
 	if er != nil {
 		return fmt.Errorf("build failed: %s", er)
@@ -439,14 +867,44 @@ func (config *Config) buildRunnerImage() error {
 	defer res.Body.Close()
 
 	// ビルドの出力を表示
-	if _, err = io.Copy(os.Stdout, res.Body); err != nil {
+	if _, err := io.Copy(os.Stdout, res.Body); err != nil {
 		return fmt.Errorf("Error reading build output: %s", err)
 	}
 
-	log.Println("Docker image built successfully!")
+	log.Println("Docker image", options.Tags, "built successfully!")
 	return nil
 }
 
+// テンプレートのDockerfileは生成済みのものに置き換える
+func (config *Config) skipContextFile(fi os.FileInfo) bool {
+	return config.Dockerfile == "" && strings.HasPrefix(fi.Name(), "Dockerfile")
+}
+
+// ビルドコンテキストに入れるファイルのパスと内容のハッシュ
+func (config *Config) contextDigest() (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(config.BuildContext, func(file string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || config.skipContextFile(fi) {
+			return err
+		}
+		relPath, err := filepath.Rel(config.BuildContext, file)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		io.WriteString(h, relPath+"\x00")
+		h.Write(data)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read build context: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func (config *Config) createBuildContext(dir string) (io.ReadCloser, error) {
 	var buf bytes.Buffer
 	tw := tar.NewWriter(&buf)
@@ -462,7 +920,7 @@ func (config *Config) createBuildContext(dir string) (io.ReadCloser, error) {
 			return nil
 		}
 
-		if strings.HasPrefix(fi.Name(), "Dockerfile") && fi.Name() != "Dockerfile"+config.BaseImage {
+		if config.skipContextFile(fi) {
 			return nil
 		}
 
@@ -497,6 +955,37 @@ func (config *Config) createBuildContext(dir string) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("failed to tar directory: %w", err)
 	}
 
+	dockerfile, err := config.baseDockerfile()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addTarFile(tw, buildDockerfile, dockerfile, 0644); err != nil {
+		return nil, fmt.Errorf("failed to add dockerfile: %w", err)
+	}
+
+	if err := config.Layer.addTo(tw); err != nil {
+		return nil, err
+	}
+
+	// オフラインの場合はランナーのtarballをダウンロードせずにコンテキストから使う
+	if err := tw.WriteHeader(&tar.Header{Name: artifactsDir + "/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: time.Now()}); err != nil {
+		return nil, fmt.Errorf("failed to add %s: %w", artifactsDir, err)
+	}
+	if config.Offline != nil {
+		tarball, err := config.runnerTarball()
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(filepath.Join(config.Offline.ArtifactsDir, tarball))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read runner tarball: %w", err)
+		}
+		if err := addTarFile(tw, artifactsDir+"/"+tarball, data, 0644); err != nil {
+			return nil, fmt.Errorf("failed to add runner tarball: %w", err)
+		}
+	}
+
 	// tarアーカイブをクローズ
 	if err := tw.Close(); err != nil {
 		return nil, fmt.Errorf("failed to close tar writer: %w", err)
@@ -506,10 +995,45 @@ func (config *Config) createBuildContext(dir string) (io.ReadCloser, error) {
 	return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
 }
 
-func (config *Config) hasToBuild() (bool, error) {
-	list, e := config.Cli.ImageList(config.Ctx, image.ListOptions{Filters: filters.NewArgs(filters.KeyValuePair{Key: "reference", Value: config.imageName()})})
+// ベースのDockerfileにパッケージとセットアップスクリプトのレイヤーを追加する
+func (config *Config) baseDockerfile() ([]byte, error) {
+	dockerfile, err := os.ReadFile(config.dockerfilePath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dockerfile: %w", err)
+	}
+	dockerfile = append(dockerfile, config.Layer.dockerfile()...)
+	// aptのプロキシはビルドの間だけ使う
+	if config.aptProxy() != "" {
+		dockerfile = append(dockerfile, aptProxyEnd()...)
+	}
+	return dockerfile, nil
+}
+
+func (config *Config) dockerfilePath() string {
+	if config.Dockerfile != "" {
+		return config.Dockerfile
+	}
+	return templateDir + "/Dockerfile" + config.BaseImage
+}
+
+func addTarFile(tw *tar.Writer, name string, data []byte, mode int64) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    mode,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func (config *Config) hasToBuild(name string) (bool, error) {
+	list, e := config.Cli.ImageList(config.Ctx, image.ListOptions{Filters: filters.NewArgs(filters.KeyValuePair{Key: "reference", Value: name})})
 	if e != nil {
-		return true, fmt.Errorf("does not find %s can not get image list %w", config.imageName(), e)
+		return true, fmt.Errorf("does not find %s can not get image list %w", name, e)
 	}
 	if len(list) > 0 {
 		return false, nil
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -21,6 +23,11 @@ func TestImageName(t *testing.T) {
 			param: &Config{ImageHost: "localhost:5000", BaseImage: "ubuntu", Version: "2.322.0"},
 			want:  "localhost:5000/local-runner:ubuntu-2.322.0",
 		},
+		{
+			name:  "with base digest",
+			param: &Config{BaseImage: "ubuntu", Version: "2.322.0", BaseDigest: "0123456789ab"},
+			want:  "local-runner:ubuntu-2.322.0-0123456789ab",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -35,6 +42,49 @@ func TestImageName(t *testing.T) {
 	}
 }
 
+func TestBaseDigest(t *testing.T) {
+	parse := func(config string) *Config {
+		t.Helper()
+		c, err := parseConfig([]byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	runner := `"runner": {"owner": "tkmsaaaam", "auth": {"access_token": "example_access_token"}}`
+	base := parse(`{"base_image": "Noble", "build_args": {"node": "20"}, ` + runner + `}`)
+	same := parse(`{"base_image": "Noble", "build_args": {"node": "20"}, ` + runner + `}`)
+	changed := parse(`{"base_image": "Noble", "build_args": {"node": "22"}, ` + runner + `}`)
+	layer := parse(`{"base_image": "Noble", "build_args": {"node": "20"}, "packages": ["git"], ` + runner + `}`)
+
+	if base.imageName() != same.imageName() {
+		t.Errorf("imageName() same config = \n%v, want \n%v", same.imageName(), base.imageName())
+	}
+	if base.imageName() == changed.imageName() {
+		t.Errorf("imageName() changed build_args = \n%v", changed.imageName())
+	}
+	if base.imageName() == layer.imageName() {
+		t.Errorf("imageName() changed packages = \n%v", layer.imageName())
+	}
+
+	// ビルドコンテキストのファイルを変えても別のタグになる
+	dir := t.TempDir()
+	dockerfile := filepath.Join(dir, "Dockerfile")
+	if err := os.WriteFile(dockerfile, []byte("FROM ubuntu:24.04\nCOPY start.sh /\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "start.sh"), []byte("run.sh"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	custom := parse(`{"dockerfile": "` + dockerfile + `", ` + runner + `}`)
+	if err := os.WriteFile(filepath.Join(dir, "start.sh"), []byte("run.sh --once"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if edited := parse(`{"dockerfile": "` + dockerfile + `", ` + runner + `}`); custom.imageName() == edited.imageName() {
+		t.Errorf("imageName() changed build context = \n%v", edited.imageName())
+	}
+}
+
 func TestMakeConfig(t *testing.T) {
 	type want struct {
 		config *Config
@@ -49,7 +99,17 @@ func TestMakeConfig(t *testing.T) {
 		{
 			name:  "invalid json",
 			param: []byte(`{`),
-			want:  want{config: nil, err: fmt.Errorf("Config file (config.json) is invalid.")},
+			want:  want{config: nil, err: fmt.Errorf("Config file (config.json) is invalid. line 1, column 2: unexpected end of JSON input")},
+		},
+		{
+			name:  "unknown field",
+			param: []byte("{\n  \"runner\": {\"owner\": \"tkmsaaaam\", \"token\": \"xxx\"}\n}"),
+			want:  want{config: nil, err: fmt.Errorf("Config file (config.json) is invalid. runner.token at line 2, column 36: unknown field")},
+		},
+		{
+			name:  "runner is nil",
+			param: []byte(`{"limit": 1}`),
+			want:  want{config: nil, err: fmt.Errorf("Runner is not valid in config.json runner is required")},
 		},
 		{
 			name:  "runner is not present",
@@ -61,6 +121,26 @@ func TestMakeConfig(t *testing.T) {
 			param: []byte(`{"limit": 1, "base_image": "Noble", "runner": {"owner": "tkmsaaaam", "auth": {"is_app": false, "access_token": "example_access_token"}}}`),
 			want:  want{config: &Config{Limit: 1, BaseImage: "Noble", Version: "2.322.0"}, err: nil},
 		},
+		{
+			name:  "dockerfile is not present",
+			param: []byte(`{"dockerfile": "./not_found/Dockerfile", "runner": {"owner": "tkmsaaaam", "auth": {"is_app": false, "access_token": "example_access_token"}}}`),
+			want:  want{config: nil, err: fmt.Errorf("Can not find ./not_found/Dockerfile")},
+		},
+		{
+			name:  "reserved build arg",
+			param: []byte(`{"build_args": {"arch": "x64"}, "runner": {"owner": "tkmsaaaam", "auth": {"is_app": false, "access_token": "example_access_token"}}}`),
+			want:  want{config: nil, err: fmt.Errorf("build_args.arch is reserved")},
+		},
+		{
+			name:  "invalid package name",
+			param: []byte(`{"packages": ["git; rm -rf /"], "runner": {"owner": "tkmsaaaam", "auth": {"is_app": false, "access_token": "example_access_token"}}}`),
+			want:  want{config: nil, err: fmt.Errorf("Invalid package name git; rm -rf /")},
+		},
+		{
+			name:  "custom dockerfile",
+			param: []byte(`{"dockerfile": "./dockerfiles/DockerfileNoble", "runner": {"owner": "tkmsaaaam", "auth": {"is_app": false, "access_token": "example_access_token"}}}`),
+			want:  want{config: &Config{Limit: 2, BaseImage: "Custom", Version: "2.322.0"}, err: nil},
+		},
 		{
 			name:  "custom config",
 			param: []byte(`{"image_host": "localhost:5000", "base_image": "Noble", "runner": {"owner": "tkmsaaaam", "auth": {"is_app": false, "access_token": "example_access_token"}}}`),
@@ -120,6 +200,26 @@ func TestRunnerValidate(t *testing.T) {
 			param: &Runner{Owner: "owner"},
 			want:  fmt.Errorf("auth is required"),
 		},
+		{
+			name:  "enterprise with owner",
+			param: &Runner{Enterprise: "slug", Owner: "owner", Auth: &Auth{AccessToken: "access_token"}},
+			want:  fmt.Errorf("owner and repository can not be set with enterprise"),
+		},
+		{
+			name:  "enterprise with app",
+			param: &Runner{Enterprise: "slug", Auth: &Auth{IsApp: true, App: App{KeyPath: "/path", Id: 1, InstallationId: 1}}},
+			want:  fmt.Errorf("enterprise requires access_token"),
+		},
+		{
+			name:  "runner group with repository",
+			param: &Runner{Owner: "owner", Repository: "repo", RunnerGroup: "laptops", Auth: &Auth{AccessToken: "access_token"}},
+			want:  fmt.Errorf("runner_group can not be set with repository"),
+		},
+		{
+			name:  "valid enterprise",
+			param: &Runner{Enterprise: "slug", RunnerGroup: "laptops", Auth: &Auth{AccessToken: "access_token"}},
+			want:  nil,
+		},
 		{
 			name:  "valid",
 			param: &Runner{Owner: "owner", Auth: &Auth{IsApp: false, AccessToken: "access_token"}},
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+)
+
+// インターネットに接続できない環境でビルドするための設定
+type Offline struct {
+	ArtifactsDir string `json:"artifacts_dir"`
+	AptProxy     string `json:"apt_proxy"`
+}
+
+// ビルドコンテキスト内でランナーのtarballを置くディレクトリ
+const artifactsDir = "artifacts"
+
+// ビルド中だけaptが使うプロキシの設定。実行時のコンテナには残さない
+const aptProxyFile = "/etc/apt/apt.conf.d/01proxy"
+
+func (config *Config) aptProxy() string {
+	if config.Offline == nil {
+		return ""
+	}
+	return config.Offline.AptProxy
+}
+
+// apt_proxyのビルド引数からプロキシの設定を置く命令
+func aptProxyStart() string {
+	return "\nARG apt_proxy=\"\"\nRUN if [ -n \"${apt_proxy}\" ]; then echo \"Acquire::http::Proxy \\\"${apt_proxy}\\\";\" > " + aptProxyFile + "; fi\n"
+}
+
+func aptProxyEnd() string {
+	return "\nRUN rm -f " + aptProxyFile + "\n"
+}
+
+var checksumPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func (offline *Offline) validate() error {
+	if offline.ArtifactsDir == "" {
+		return fmt.Errorf("artifacts_dir is required")
+	}
+	if fi, err := os.Stat(offline.ArtifactsDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("Can not find artifacts_dir %s", offline.ArtifactsDir)
+	}
+	return nil
+}
+
+func (config *Config) runnerTarball() (string, error) {
+	arch, err := runnerArch(config.targetArch())
+	if err != nil {
+		return "", err
+	}
+	return "actions-runner-linux-" + arch + "-" + config.Version + ".tar.gz", nil
+}
+
+// オフラインビルドに必要でartifacts_dirにないファイル
+func (config *Config) missingArtifactFiles() ([]string, error) {
+	tarball, err := config.runnerTarball()
+	if err != nil {
+		return nil, err
+	}
+	missing := []string{}
+	for _, name := range []string{tarball, tarball + ".sha256"} {
+		p := filepath.Join(config.Offline.ArtifactsDir, name)
+		if fi, err := os.Stat(p); err != nil || fi.IsDir() {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
+
+// オフラインビルドに必要でローカルにないイメージ
+func (config *Config) missingBaseImages() ([]string, error) {
+	dockerfile, err := os.ReadFile(config.dockerfilePath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dockerfile: %w", err)
+	}
+	missing := []string{}
+	for _, name := range parseFromImages(dockerfile) {
+		list, err := config.Cli.ImageList(config.Ctx, image.ListOptions{Filters: filters.NewArgs(filters.KeyValuePair{Key: "reference", Value: name})})
+		if err != nil {
+			return nil, fmt.Errorf("can not get image list %w", err)
+		}
+		if len(list) == 0 {
+			missing = append(missing, "image "+name)
+		}
+	}
+	return missing, nil
+}
+
+// 足りないものを全て挙げてビルド前に失敗させる
+func (config *Config) checkArtifacts() error {
+	files, err := config.missingArtifactFiles()
+	if err != nil {
+		return err
+	}
+	images, err := config.missingBaseImages()
+	if err != nil {
+		return err
+	}
+	missing := append(files, images...)
+	if len(missing) > 0 {
+		return fmt.Errorf("missing artifacts for offline build:\n  %s", strings.Join(missing, "\n  "))
+	}
+	return nil
+}
+
+// DockerfileのFROMで参照しているイメージ。ステージ名とscratchは除く
+func parseFromImages(dockerfile []byte) []string {
+	images := []string{}
+	stages := map[string]bool{"scratch": true}
+	scanner := bufio.NewScanner(bytes.NewReader(dockerfile))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+		args := fields[1:]
+		for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if !stages[strings.ToLower(args[0])] && !strings.Contains(args[0], "$") {
+			images = append(images, args[0])
+		}
+		if len(args) == 3 && strings.EqualFold(args[1], "AS") {
+			stages[strings.ToLower(args[2])] = true
+		}
+	}
+	return images
+}
+
+func readChecksumFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("can not read checksum %s", err)
+	}
+	// sha256sumの出力形式(ハッシュ ファイル名)にも対応する
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || !checksumPattern.MatchString(fields[0]) {
+		return "", fmt.Errorf("invalid checksum in %s", path)
+	}
+	return fields[0], nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseFromImages(t *testing.T) {
+	tests := []struct {
+		name  string
+		param string
+		want  []string
+	}{
+		{
+			name:  "single stage",
+			param: "FROM ubuntu:22.04\nRUN apt-get update\n",
+			want:  []string{"ubuntu:22.04"},
+		},
+		{
+			name:  "multi stage",
+			param: "FROM --platform=linux/amd64 golang:1.23 AS build\nFROM build AS test\nfrom debian:bookworm\nCOPY --from=build /app /app\n",
+			want:  []string{"golang:1.23", "debian:bookworm"},
+		},
+		{
+			name:  "scratch and args",
+			param: "ARG base=ubuntu\nFROM ${base}\nFROM scratch\n",
+			want:  []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := parseFromImages([]byte(tt.param))
+
+			if !slices.Equal(actual, tt.want) {
+				t.Errorf("parseFromImages() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadChecksumFile(t *testing.T) {
+	dir := t.TempDir()
+	type want struct {
+		checksum string
+		err      error
+	}
+	tests := []struct {
+		name  string
+		param string
+		want  want
+	}{
+		{
+			name:  "hash only",
+			param: checksum + "\n",
+			want:  want{checksum: checksum, err: nil},
+		},
+		{
+			name:  "sha256sum output",
+			param: checksum + "  actions-runner-linux-x64-2.322.0.tar.gz\n",
+			want:  want{checksum: checksum, err: nil},
+		},
+		{
+			name:  "invalid",
+			param: "abc",
+			want:  want{checksum: "", err: fmt.Errorf("invalid checksum in %s", filepath.Join(dir, "invalid"))},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			p := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(p, []byte(tt.param), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			actual, actualError := readChecksumFile(p)
+
+			if actual != tt.want.checksum {
+				t.Errorf("readChecksumFile() = \n%v, want \n%v", actual, tt.want.checksum)
+			}
+			assert(t, "readChecksumFile() error", actualError, tt.want.err)
+		})
+	}
+}
+
+func TestMissingArtifactFiles(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{Version: "2.322.0", Arch: "amd64", Offline: &Offline{ArtifactsDir: dir}}
+	if err := os.WriteFile(filepath.Join(dir, "actions-runner-linux-x64-2.322.0.tar.gz"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := config.missingArtifactFiles()
+	if err != nil {
+		t.Fatalf("missingArtifactFiles() error = %v", err)
+	}
+
+	want := []string{filepath.Join(dir, "actions-runner-linux-x64-2.322.0.tar.gz.sha256")}
+	if !slices.Equal(actual, want) {
+		t.Errorf("missingArtifactFiles() = \n%v, want \n%v", actual, want)
+	}
+}
+
+func TestBaseDockerfileAptProxy(t *testing.T) {
+	config := &Config{BaseImage: "Noble", Layer: &Layer{Packages: []string{"git"}}}
+	dockerfile, err := config.baseDockerfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(dockerfile), "rm -f /etc/apt/apt.conf.d/01proxy") {
+		t.Errorf("baseDockerfile() without proxy = \n%s", dockerfile)
+	}
+
+	config.Offline = &Offline{ArtifactsDir: t.TempDir(), AptProxy: "http://127.0.0.1:3142"}
+	dockerfile, err = config.baseDockerfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// パッケージをインストールした後に消す
+	if !strings.HasSuffix(string(dockerfile), "apt-get install git -y && \\\n  rm -rf /var/lib/apt/lists/*\n\nRUN rm -f /etc/apt/apt.conf.d/01proxy\n") {
+		t.Errorf("baseDockerfile() with proxy = \n%s", dockerfile)
+	}
+	want := "\nARG apt_proxy=\"\"\nRUN if [ -n \"${apt_proxy}\" ]; then echo \"Acquire::http::Proxy \\\"${apt_proxy}\\\";\" > /etc/apt/apt.conf.d/01proxy; fi\n"
+	if actual := aptProxyStart(); actual != want {
+		t.Errorf("aptProxyStart() = \n%v, want \n%v", actual, want)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// ベースイメージまたはプールのイメージに重ねるレイヤー
+type Layer struct {
+	Packages     []string `json:"packages"`
+	SetupScripts []string `json:"setup_scripts"`
+	Files        []File   `json:"files"`
+}
+
+type File struct {
+	Src  string `json:"src"`
+	Dest string `json:"dest"`
+}
+
+type PoolEnv struct {
+	Name    string   `json:"name"`
+	Limit   int      `json:"limit"`
+	Warm    int      `json:"warm"`
+	Labels  []string `json:"labels"`
+	Backend string   `json:"backend"`
+	Layer
+}
+
+// 同じ設定のランナーをまとめたもの
+type Pool struct {
+	Name  string
+	Limit int
+	// 作成だけして起動を待つコンテナの数
+	Warm    int
+	Labels  []string
+	Overlay *Layer
+	Digest  string
+	Backend string
+	// 初期化済みのスナップショットのイメージ名
+	Snapshot string
+	// 一時停止中は新しいコンテナを作らない
+	Paused bool
+	// 続けてすぐに失敗した回数と次のコンテナを作れるようになる時刻
+	Failures     int
+	BackoffUntil time.Time
+	LastError    string
+}
+
+const defaultPoolName = "default"
+
+// コンテナとイメージに付けるラベル
+const poolLabel = "local-runner.pool"
+const parentImageLabel = "local-runner.parent"
+
+var poolNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+func makePools(env *Env, limit int) ([]*Pool, error) {
+	if env.Warm < 0 {
+		return nil, fmt.Errorf("warm must not be negative")
+	}
+	if len(env.Pools) == 0 {
+		return []*Pool{{Name: defaultPoolName, Limit: limit, Warm: env.Warm, Backend: env.Backend}}, nil
+	}
+	pools := []*Pool{}
+	names := map[string]bool{}
+	for _, p := range env.Pools {
+		if !poolNamePattern.MatchString(p.Name) {
+			return nil, fmt.Errorf("Invalid pool name %s", p.Name)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("Duplicated pool name %s", p.Name)
+		}
+		names[p.Name] = true
+
+		if err := p.Layer.validate(); err != nil {
+			return nil, fmt.Errorf("pool %s is invalid %s", p.Name, err)
+		}
+		digest, err := p.Layer.digest()
+		if err != nil {
+			return nil, fmt.Errorf("pool %s is invalid %s", p.Name, err)
+		}
+
+		poolLimit := p.Limit
+		if poolLimit == 0 {
+			poolLimit = limit
+		}
+		if p.Warm < 0 {
+			return nil, fmt.Errorf("pool %s is invalid warm must not be negative", p.Name)
+		}
+		warm := p.Warm
+		if warm == 0 {
+			warm = env.Warm
+		}
+		backend := p.Backend
+		if backend == "" {
+			backend = env.Backend
+		}
+		layer := p.Layer
+		pools = append(pools, &Pool{Name: p.Name, Limit: poolLimit, Warm: warm, Labels: p.Labels, Overlay: &layer, Digest: digest, Backend: backend})
+	}
+	return pools, nil
+}
+
+func (config *Config) findPool(name string) *Pool {
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	return config.findPoolLocked(name)
+}
+
+func (config *Config) findPoolLocked(name string) *Pool {
+	for _, p := range config.Pools {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// プールのイメージ名。オーバーレイがなければベースイメージをそのまま使う
+func (config *Config) poolImageName(pool *Pool) string {
+	if !config.hasPoolImage(pool) {
+		return config.imageName()
+	}
+	return config.imageName() + "-" + pool.Name + "-" + config.poolDigest(pool)[:12]
+}
+
+func (config *Config) hasPoolImage(pool *Pool) bool {
+	return !pool.Overlay.empty() || config.backend(pool).dockerfile(config) != ""
+}
+
+// オーバーレイとバックエンドが追加する命令のハッシュ
+func (config *Config) poolDigest(pool *Pool) string {
+	backend := config.backend(pool).dockerfile(config)
+	if backend == "" {
+		return pool.Digest
+	}
+	sum := sha256.Sum256([]byte(pool.Digest + backend))
+	return hex.EncodeToString(sum[:])
+}
+
+// ランナーに付けるラベル
+func (config *Config) poolLabels(pool *Pool) []string {
+	return append(append([]string{}, config.Labels...), pool.Labels...)
+}
+
+// ベースイメージから派生したプールのイメージをビルドする
+func (config *Config) buildPoolImage(pool *Pool) error {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	backend := config.backend(pool)
+	body := backend.dockerfile(config) + pool.Overlay.dockerfile()
+	// ベースイメージにはプロキシの設定を残さないので派生イメージでも置き直す
+	var args map[string]*string
+	if proxy := config.aptProxy(); proxy != "" {
+		body = aptProxyStart() + body + aptProxyEnd()
+		args = map[string]*string{"apt_proxy": &proxy}
+	}
+	dockerfile := "FROM " + config.imageName() + "\n" + body
+	if err := addTarFile(tw, buildDockerfile, []byte(dockerfile), 0644); err != nil {
+		return fmt.Errorf("failed to add dockerfile: %w", err)
+	}
+	if err := backend.addTo(config, tw); err != nil {
+		return err
+	}
+	if err := pool.Overlay.addTo(tw); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close tar writer: %w", err)
+	}
+
+	options := types.ImageBuildOptions{
+		Tags:       []string{config.poolImageName(pool)},
+		Dockerfile: buildDockerfile,
+		Remove:     true,
+		Labels:     map[string]string{parentImageLabel: config.imageName(), poolLabel: pool.Name},
+		BuildArgs:  args,
+		Platform:   config.platform(),
+	}
+	return config.runImageBuild(io.NopCloser(&buf), options)
+}
+
+// ベースイメージと各プールのイメージを必要に応じてビルドする。forceの場合は全て作り直す
+func (config *Config) buildImages(force bool) error {
+	build := force
+	if !build {
+		b, err := config.hasToBuild(config.imageName())
+		if err != nil {
+			return err
+		}
+		build = b
+	}
+	if build {
+		if err := config.buildRunnerImage(); err != nil {
+			return err
+		}
+	}
+	for _, pool := range config.poolList() {
+		if !config.hasPoolImage(pool) {
+			continue
+		}
+		b, err := config.hasToBuild(config.poolImageName(pool))
+		if err != nil {
+			return err
+		}
+		// ベースイメージを作り直した場合は派生イメージも作り直す
+		if build || b {
+			if err := config.buildPoolImage(pool); err != nil {
+				return fmt.Errorf("pool %s %w", pool.Name, err)
+			}
+		}
+	}
+	return config.primeImages(build)
+}
+
+func (layer *Layer) empty() bool {
+	return layer == nil || (len(layer.Packages) == 0 && len(layer.SetupScripts) == 0 && len(layer.Files) == 0)
+}
+
+func (layer *Layer) validate() error {
+	for _, p := range layer.Packages {
+		if !packageNamePattern.MatchString(p) {
+			return fmt.Errorf("Invalid package name %s", p)
+		}
+	}
+	for _, s := range layer.SetupScripts {
+		if fi, err := os.Stat(s); err != nil || fi.IsDir() {
+			return fmt.Errorf("Can not find setup script %s", s)
+		}
+	}
+	for _, f := range layer.Files {
+		if fi, err := os.Stat(f.Src); err != nil || fi.IsDir() {
+			return fmt.Errorf("Can not find file %s", f.Src)
+		}
+		if !filepath.IsAbs(f.Dest) {
+			return fmt.Errorf("dest of %s must be absolute", f.Src)
+		}
+	}
+	return nil
+}
+
+// Dockerfileの後ろに追加する命令
+func (layer *Layer) dockerfile() string {
+	if layer == nil {
+		return ""
+	}
+	var b strings.Builder
+	if len(layer.Packages) > 0 {
+		b.WriteString("\nRUN apt-get update && \\\n  apt-get install " + strings.Join(layer.Packages, " ") + " -y && \\\n  rm -rf /var/lib/apt/lists/*\n")
+	}
+	for i, f := range layer.Files {
+		b.WriteString("\nCOPY " + layerFileName(i, f.Src) + " " + f.Dest + "\n")
+	}
+	for i, s := range layer.SetupScripts {
+		name := setupScriptName(i, s)
+		b.WriteString("\nCOPY " + name + " /actions-runner/" + name + "\n")
+		b.WriteString("RUN /bin/bash /actions-runner/" + name + "\n")
+	}
+	return b.String()
+}
+
+// レイヤーで使うファイルをビルドコンテキストに追加する
+func (layer *Layer) addTo(tw *tar.Writer) error {
+	if layer == nil {
+		return nil
+	}
+	for i, f := range layer.Files {
+		data, err := os.ReadFile(f.Src)
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		if err := addTarFile(tw, layerFileName(i, f.Src), data, 0644); err != nil {
+			return fmt.Errorf("failed to add file: %w", err)
+		}
+	}
+	for i, s := range layer.SetupScripts {
+		data, err := os.ReadFile(s)
+		if err != nil {
+			return fmt.Errorf("failed to read setup script: %w", err)
+		}
+		if err := addTarFile(tw, setupScriptName(i, s), data, 0755); err != nil {
+			return fmt.Errorf("failed to add setup script: %w", err)
+		}
+	}
+	return nil
+}
+
+// レイヤーの内容が変わった時だけイメージを作り直すためのハッシュ
+func (layer *Layer) digest() (string, error) {
+	h := sha256.New()
+	io.WriteString(h, layer.dockerfile())
+	for _, f := range layer.Files {
+		data, err := os.ReadFile(f.Src)
+		if err != nil {
+			return "", fmt.Errorf("failed to read file: %w", err)
+		}
+		h.Write(data)
+	}
+	for _, s := range layer.SetupScripts {
+		data, err := os.ReadFile(s)
+		if err != nil {
+			return "", fmt.Errorf("failed to read setup script: %w", err)
+		}
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func setupScriptName(i int, path string) string {
+	return fmt.Sprintf("setup.d/%02d-%s", i, filepath.Base(path))
+}
+
+func layerFileName(i int, path string) string {
+	return fmt.Sprintf("files.d/%02d-%s", i, filepath.Base(path))
+}
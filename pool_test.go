@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLayerDockerfile(t *testing.T) {
+	tests := []struct {
+		name  string
+		param *Layer
+		want  string
+	}{
+		{
+			name:  "nil",
+			param: nil,
+			want:  "",
+		},
+		{
+			name:  "no layers",
+			param: &Layer{},
+			want:  "",
+		},
+		{
+			name:  "packages, files and setup scripts",
+			param: &Layer{Packages: []string{"git", "make"}, SetupScripts: []string{"/path/to/install-go.sh"}, Files: []File{{Src: "/path/to/.npmrc", Dest: "/root/.npmrc"}}},
+			want:  "\nRUN apt-get update && \\\n  apt-get install git make -y && \\\n  rm -rf /var/lib/apt/lists/*\n\nCOPY files.d/00-.npmrc /root/.npmrc\n\nCOPY setup.d/00-install-go.sh /actions-runner/setup.d/00-install-go.sh\nRUN /bin/bash /actions-runner/setup.d/00-install-go.sh\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := tt.param.dockerfile()
+
+			if actual != tt.want {
+				t.Errorf("layer.dockerfile() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolImageName(t *testing.T) {
+	config := &Config{BaseImage: "Jammy", Version: "2.322.0"}
+	tests := []struct {
+		name  string
+		param *Pool
+		want  string
+	}{
+		{
+			name:  "without overlay",
+			param: &Pool{Name: "default"},
+			want:  "local-runner:Jammy-2.322.0",
+		},
+		{
+			name:  "with overlay",
+			param: &Pool{Name: "go", Overlay: &Layer{Packages: []string{"golang"}}, Digest: "0123456789abcdef"},
+			want:  "local-runner:Jammy-2.322.0-go-0123456789ab",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := config.poolImageName(tt.param)
+
+			if actual != tt.want {
+				t.Errorf("poolImageName() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakePools(t *testing.T) {
+	type want struct {
+		pools []*Pool
+		err   error
+	}
+	tests := []struct {
+		name  string
+		param *Env
+		want  want
+	}{
+		{
+			name:  "default pool",
+			param: &Env{},
+			want:  want{pools: []*Pool{{Name: "default", Limit: 2}}, err: nil},
+		},
+		{
+			name:  "invalid name",
+			param: &Env{Pools: []PoolEnv{{Name: "Go Pool"}}},
+			want:  want{pools: nil, err: fmt.Errorf("Invalid pool name Go Pool")},
+		},
+		{
+			name:  "duplicated name",
+			param: &Env{Pools: []PoolEnv{{Name: "go"}, {Name: "go"}}},
+			want:  want{pools: nil, err: fmt.Errorf("Duplicated pool name go")},
+		},
+		{
+			name:  "invalid layer",
+			param: &Env{Pools: []PoolEnv{{Name: "go", Layer: Layer{Files: []File{{Src: "./pool.go", Dest: "pool.go"}}}}}},
+			want:  want{pools: nil, err: fmt.Errorf("pool go is invalid dest of ./pool.go must be absolute")},
+		},
+		{
+			name:  "pools",
+			param: &Env{Pools: []PoolEnv{{Name: "go", Limit: 1, Layer: Layer{Packages: []string{"golang"}}}, {Name: "node"}}},
+			want:  want{pools: []*Pool{{Name: "go", Limit: 1}, {Name: "node", Limit: 2}}, err: nil},
+		},
+		{
+			name:  "warm",
+			param: &Env{Warm: 1, Pools: []PoolEnv{{Name: "go", Warm: 3}, {Name: "node"}}},
+			want:  want{pools: []*Pool{{Name: "go", Limit: 2, Warm: 3}, {Name: "node", Limit: 2, Warm: 1}}, err: nil},
+		},
+		{
+			name:  "negative warm",
+			param: &Env{Pools: []PoolEnv{{Name: "go", Warm: -1}}},
+			want:  want{pools: nil, err: fmt.Errorf("pool go is invalid warm must not be negative")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual, actualError := makePools(tt.param, 2)
+
+			if len(actual) != len(tt.want.pools) {
+				t.Fatalf("makePools() = \n%v, want \n%v", actual, tt.want.pools)
+			}
+			for i, p := range actual {
+				if p.Name != tt.want.pools[i].Name || p.Limit != tt.want.pools[i].Limit || p.Warm != tt.want.pools[i].Warm {
+					t.Errorf("makePools()[%d] = \n%v, want \n%v", i, p, tt.want.pools[i])
+				}
+			}
+			assert(t, "makePools() error", actualError, tt.want.err)
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 全てのプールのリクエストの最小の間隔
+const minRequestInterval = 100 * time.Millisecond
+
+// 残りがこの割合を下回ったらリセットまでの時間に残りのリクエストを均等に割り振る
+const rateLimitReserve = 0.1
+
+// レート制限に掛かった時に再試行する回数
+const rateLimitRetries = 2
+
+// Retry-Afterもリセット時刻もない二次レート制限で最初に待つ時間
+const secondaryLimitBackoff = time.Minute
+
+// これより長く待つ必要がある場合は待たずにエラーにする
+const maxRateLimitWait = 5 * time.Minute
+
+// コンテナを作る間はプールのロックを持っているので、これより長く待つ場合はプールのバックオフに任せる
+const maxPoolRateLimitWait = 10 * time.Second
+
+// APIごとのレート制限。同じAPIを使う全てのプールで共有する
+type RateLimit struct {
+	Now   func() time.Time
+	Sleep func(time.Duration)
+
+	mu        sync.Mutex
+	limit     int
+	remaining int
+	reset     time.Time
+	// 次のリクエストを送ってよい時刻
+	next time.Time
+	// レート制限に掛かって待つ必要がある時刻
+	blocked time.Time
+	backoff time.Duration
+}
+
+// statusで表示するレート制限の状態
+type RateLimitStatus struct {
+	Api       string    `json:"api"`
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+type RateLimits struct {
+	mu     sync.Mutex
+	limits map[string]*RateLimit
+}
+
+var rateLimits = &RateLimits{}
+
+func (l *RateLimits) get(apiBase string) *RateLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits == nil {
+		l.limits = map[string]*RateLimit{}
+	}
+	r, ok := l.limits[apiBase]
+	if !ok {
+		r = &RateLimit{}
+		l.limits[apiBase] = r
+	}
+	return r
+}
+
+func (r *RateLimit) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
+
+func (r *RateLimit) sleep(d time.Duration) {
+	if r.Sleep != nil {
+		r.Sleep(d)
+		return
+	}
+	time.Sleep(d)
+}
+
+// 次のリクエストを送れるまで待つ。リクエストの順番は呼んだ順に予約する
+func (r *RateLimit) wait(maxWait time.Duration) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	now := r.now()
+	start := now
+	if r.next.After(start) {
+		start = r.next
+	}
+	if r.blocked.After(start) {
+		start = r.blocked
+	}
+	if start.Sub(now) > maxWait {
+		r.mu.Unlock()
+		return fmt.Errorf("API is rate limited until %s", start.Format(time.RFC3339))
+	}
+	r.next = start.Add(r.intervalLocked(start))
+	r.mu.Unlock()
+	if d := start.Sub(now); d > 0 {
+		r.sleep(d)
+	}
+	return nil
+}
+
+func (r *RateLimit) intervalLocked(now time.Time) time.Duration {
+	if r.limit == 0 || r.remaining > int(float64(r.limit)*rateLimitReserve) || !r.reset.After(now) {
+		return minRequestInterval
+	}
+	interval := r.reset.Sub(now) / time.Duration(r.remaining+1)
+	return max(interval, minRequestInterval)
+}
+
+// レスポンスのヘッダーから残りの回数を記録する。レート制限に掛かって再試行できる場合はtrueを返す
+func (r *RateLimit) update(res *http.Response, body string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if limit, err := strconv.Atoi(res.Header.Get("X-RateLimit-Limit")); err == nil {
+		remaining, _ := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining"))
+		reset, _ := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+		low := remaining <= int(float64(limit)*rateLimitReserve) && r.remaining > int(float64(limit)*rateLimitReserve)
+		r.limit, r.remaining, r.reset = limit, remaining, time.Unix(reset, 0)
+		if low {
+			log.Printf("API rate limit is running low remaining: %d/%d reset: %s", remaining, limit, r.reset.Format(time.RFC3339))
+		}
+	}
+
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusForbidden {
+		r.backoff = 0
+		return false
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if res.Header.Get("X-RateLimit-Remaining") == "0" {
+		wait = r.reset.Sub(now) + time.Second
+	} else if res.StatusCode == http.StatusForbidden && !strings.Contains(strings.ToLower(body), "rate limit") {
+		// 権限がないだけの403は再試行しない
+		return false
+	} else {
+		// 二次レート制限は少なくとも1分待ってから倍々に延ばす
+		if r.backoff == 0 {
+			r.backoff = secondaryLimitBackoff
+		} else {
+			r.backoff *= 2
+		}
+		wait = r.backoff
+	}
+	r.blocked = now.Add(wait)
+	log.Printf("API is rate limited status: %d wait: %s", res.StatusCode, wait)
+	return true
+}
+
+// プールのバックエンドが使うAPI
+func (config *Config) apiBase(pool *Pool) string {
+	switch pool.backendName() {
+	case forgejoBackend:
+		return config.Forgejo.Url + "/api/v1"
+	case gitLabBackend:
+		return config.GitLab.Url + "/api/v4"
+	}
+	return config.Runner.apiUrl()
+}
+
+func (r *RateLimit) status(api string) *RateLimitStatus {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.limit == 0 {
+		return nil
+	}
+	return &RateLimitStatus{Api: api, Limit: r.limit, Remaining: r.remaining, Reset: r.reset}
+}
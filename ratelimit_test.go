@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitUpdate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name    string
+		status  int
+		header  map[string]string
+		body    string
+		backoff time.Duration
+		want    bool
+		blocked time.Time
+	}{
+		{
+			name:   "ok",
+			status: http.StatusOK,
+			header: map[string]string{"X-RateLimit-Limit": "5000", "X-RateLimit-Remaining": "4999", "X-RateLimit-Reset": "1700003600"},
+			want:   false,
+		},
+		{
+			name:    "retry after",
+			status:  http.StatusTooManyRequests,
+			header:  map[string]string{"Retry-After": "30"},
+			want:    true,
+			blocked: now.Add(30 * time.Second),
+		},
+		{
+			name:    "primary limit",
+			status:  http.StatusForbidden,
+			header:  map[string]string{"X-RateLimit-Limit": "5000", "X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "1700000060"},
+			want:    true,
+			blocked: now.Add(61 * time.Second),
+		},
+		{
+			name:    "secondary limit",
+			status:  http.StatusForbidden,
+			body:    `{"message": "You have exceeded a secondary rate limit."}`,
+			want:    true,
+			blocked: now.Add(time.Minute),
+		},
+		{
+			name:    "secondary limit again",
+			status:  http.StatusTooManyRequests,
+			backoff: time.Minute,
+			want:    true,
+			blocked: now.Add(2 * time.Minute),
+		},
+		{
+			name:   "forbidden",
+			status: http.StatusForbidden,
+			body:   `{"message": "Resource not accessible by integration"}`,
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			r := &RateLimit{Now: func() time.Time { return now }, backoff: tt.backoff}
+			res := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			for k, v := range tt.header {
+				res.Header.Set(k, v)
+			}
+
+			actual := r.update(res, tt.body)
+
+			if actual != tt.want {
+				t.Errorf("update() = \n%v, want \n%v", actual, tt.want)
+			}
+			if !r.blocked.Equal(tt.blocked) {
+				t.Errorf("update() blocked = \n%v, want \n%v", r.blocked, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestRateLimitWait(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name    string
+		limit   *RateLimit
+		maxWait time.Duration
+		want    []time.Duration
+		err     error
+	}{
+		{
+			name:  "paced",
+			limit: &RateLimit{},
+			want:  []time.Duration{minRequestInterval, 2 * minRequestInterval},
+		},
+		{
+			name:  "low remaining",
+			limit: &RateLimit{limit: 5000, remaining: 9, reset: now.Add(100 * time.Second)},
+			want:  []time.Duration{10 * time.Second, 19 * time.Second},
+		},
+		{
+			name:  "blocked",
+			limit: &RateLimit{blocked: now.Add(time.Minute)},
+			want:  []time.Duration{time.Minute, time.Minute + minRequestInterval, time.Minute + 2*minRequestInterval},
+		},
+		{
+			name:  "blocked too long",
+			limit: &RateLimit{blocked: now.Add(time.Hour)},
+			want:  []time.Duration{},
+			err:   fmt.Errorf("API is rate limited until %s", now.Add(time.Hour).Format(time.RFC3339)),
+		},
+		{
+			name:    "blocked too long for pool",
+			limit:   &RateLimit{blocked: now.Add(time.Minute)},
+			maxWait: maxPoolRateLimitWait,
+			want:    []time.Duration{},
+			err:     fmt.Errorf("API is rate limited until %s", now.Add(time.Minute).Format(time.RFC3339)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			sleeps := []time.Duration{}
+			tt.limit.Now = func() time.Time { return now }
+			tt.limit.Sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+			var err error
+			for i := 0; i < 3 && err == nil; i++ {
+				maxWait := tt.maxWait
+				if maxWait == 0 {
+					maxWait = maxRateLimitWait
+				}
+				err = tt.limit.wait(maxWait)
+			}
+
+			if fmt.Sprint(sleeps) != fmt.Sprint(tt.want) {
+				t.Errorf("wait() sleeps = \n%v, want \n%v", sleeps, tt.want)
+			}
+			assert(t, "wait() error", err, tt.err)
+		})
+	}
+}
+
+func TestGitHubDoRetryRateLimit(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(5000-calls))
+		w.Header().Set("X-RateLimit-Reset", "1700003600")
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"total_count": 0, "runners": []}`)
+	}))
+	defer server.Close()
+	limit := &RateLimit{Sleep: func(time.Duration) {}}
+	gh := &GitHub{ApiBase: server.URL, Token: func() (string, error) { return "token", nil }, Client: server.Client(), Limit: limit}
+
+	if _, err := gh.listRunners("/orgs/owner"); err != nil {
+		t.Fatalf("listRunners() error = %v", err)
+	}
+
+	if calls != 2 {
+		t.Errorf("listRunners() calls = \n%v, want \n%v", calls, 2)
+	}
+	if status := limit.status("api"); status == nil || status.Remaining != 4998 || status.Limit != 5000 {
+		t.Errorf("status() = \n%v", status)
+	}
+}
+
+func TestPrintStatusRateLimit(t *testing.T) {
+	rateLimit := &RateLimitStatus{Api: "https://api.github.com", Limit: 5000, Remaining: 4321, Reset: time.Now()}
+	statuses := []PoolStatus{
+		{Name: "go", Limit: 1, Image: "local-runner:go", RateLimit: rateLimit},
+		{Name: "node", Limit: 1, Image: "local-runner:node", RateLimit: rateLimit},
+	}
+	var buf bytes.Buffer
+
+	if err := printStatus(&buf, statuses); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Count(buf.String(), "https://api.github.com  4321") != 1 {
+		t.Errorf("printStatus() = \n%v", buf.String())
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime"
+)
+
+const runnerReleaseApi = "https://api.github.com/repos/actions/runner/releases/tags/v"
+
+// GOARCHとGitHub Actions Runnerのアセット名の対応
+var runnerArchs = map[string]string{
+	"amd64": "x64",
+	"arm64": "arm64",
+	"arm":   "arm",
+}
+
+// GOARCHとDockerのプラットフォームの対応
+var dockerPlatforms = map[string]string{
+	"amd64": "linux/amd64",
+	"arm64": "linux/arm64",
+	"arm":   "linux/arm/v7",
+}
+
+func runnerArch(goarch string) (string, error) {
+	arch, ok := runnerArchs[goarch]
+	if !ok {
+		return "", fmt.Errorf("unsupported arch %s", goarch)
+	}
+	return arch, nil
+}
+
+// ビルド対象のアーキテクチャ。設定がなければ実行中のマシンに合わせる
+func (config *Config) targetArch() string {
+	if config.Arch != "" {
+		return config.Arch
+	}
+	return runtime.GOARCH
+}
+
+func (config *Config) platform() string {
+	return dockerPlatforms[config.targetArch()]
+}
+
+// リリースノートに記載されたランナーのtarballのSHA256を取得する
+func fetchRunnerChecksum(client *http.Client, url, asset string) (string, error) {
+	res, err := client.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("can not get release %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("can not get release %s status: %d", url, res.StatusCode)
+	}
+	var release struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&release); err != nil {
+		return "", fmt.Errorf("can not decode release %s", err)
+	}
+	return parseRunnerChecksum(release.Body, asset)
+}
+
+func parseRunnerChecksum(body, asset string) (string, error) {
+	re := regexp.MustCompile(`<!-- BEGIN SHA ` + regexp.QuoteMeta(asset) + ` -->([0-9a-f]{64})<!-- END SHA ` + regexp.QuoteMeta(asset) + ` -->`)
+	m := re.FindStringSubmatch(body)
+	if m == nil {
+		return "", fmt.Errorf("can not find checksum of %s", asset)
+	}
+	return m[1], nil
+}
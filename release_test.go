@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const checksum = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestRunnerArch(t *testing.T) {
+	type want struct {
+		arch string
+		err  error
+	}
+	tests := []struct {
+		name  string
+		param string
+		want  want
+	}{
+		{
+			name:  "amd64",
+			param: "amd64",
+			want:  want{arch: "x64", err: nil},
+		},
+		{
+			name:  "arm64",
+			param: "arm64",
+			want:  want{arch: "arm64", err: nil},
+		},
+		{
+			name:  "arm",
+			param: "arm",
+			want:  want{arch: "arm", err: nil},
+		},
+		{
+			name:  "unsupported",
+			param: "riscv64",
+			want:  want{arch: "", err: fmt.Errorf("unsupported arch riscv64")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual, actualError := runnerArch(tt.param)
+
+			if actual != tt.want.arch {
+				t.Errorf("runnerArch() = \n%v, want \n%v", actual, tt.want.arch)
+			}
+			assert(t, "runnerArch() error", actualError, tt.want.err)
+		})
+	}
+}
+
+func TestParseRunnerChecksum(t *testing.T) {
+	body := "- actions-runner-linux-x64-2.322.0.tar.gz <!-- BEGIN SHA linux-x64 -->" + checksum + "<!-- END SHA linux-x64 -->"
+	type want struct {
+		checksum string
+		err      error
+	}
+	tests := []struct {
+		name  string
+		param string
+		want  want
+	}{
+		{
+			name:  "found",
+			param: "linux-x64",
+			want:  want{checksum: checksum, err: nil},
+		},
+		{
+			name:  "not found",
+			param: "linux-arm64",
+			want:  want{checksum: "", err: fmt.Errorf("can not find checksum of linux-arm64")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual, actualError := parseRunnerChecksum(body, tt.param)
+
+			if actual != tt.want.checksum {
+				t.Errorf("parseRunnerChecksum() = \n%v, want \n%v", actual, tt.want.checksum)
+			}
+			assert(t, "parseRunnerChecksum() error", actualError, tt.want.err)
+		})
+	}
+}
+
+func TestFetchRunnerChecksum(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2.322.0" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"body": "<!-- BEGIN SHA linux-x64 -->%s<!-- END SHA linux-x64 -->"}`, checksum)
+	}))
+	defer server.Close()
+
+	actual, err := fetchRunnerChecksum(server.Client(), server.URL+"/v2.322.0", "linux-x64")
+	if err != nil {
+		t.Fatalf("fetchRunnerChecksum() error = %v", err)
+	}
+	if actual != checksum {
+		t.Errorf("fetchRunnerChecksum() = \n%v, want \n%v", actual, checksum)
+	}
+
+	_, err = fetchRunnerChecksum(server.Client(), server.URL+"/v0.0.0", "linux-x64")
+	assert(t, "fetchRunnerChecksum() error", err, fmt.Errorf("can not get release %s/v0.0.0 status: 404", server.URL))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// コンテナを作った時の設定のハッシュを付けるラベル
+const specLabel = "local-runner.spec"
+
+// 設定ファイルの変更を確認する間隔
+const watchInterval = 5 * time.Second
+
+// 再読み込みで変わった内容
+type ConfigDiff struct {
+	Rebuild bool
+	Added   []string
+	Removed []string
+	Scaled  []string
+	Rolled  []string
+}
+
+func (diff *ConfigDiff) empty() bool {
+	return !diff.Rebuild && len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Scaled) == 0 && len(diff.Rolled) == 0
+}
+
+func (config *Config) poolList() []*Pool {
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	return slices.Clone(config.Pools)
+}
+
+// ベースイメージのビルドに使う設定のハッシュ
+func (config *Config) baseSpec() string {
+	return specHash(struct {
+		Image        string
+		Dockerfile   string
+		BuildContext string
+		BuildArgs    map[string]string
+		Layer        *Layer
+		Offline      *Offline
+	}{config.imageName(), config.Dockerfile, config.BuildContext, config.BuildArgs, config.Layer, config.Offline})
+}
+
+// コンテナの環境変数、ラベル、イメージに関わる設定のハッシュ
+func (config *Config) poolSpec(pool *Pool) string {
+	// 他のバックエンドの設定が変わっても作り直さない
+	var backend any = config.Runner
+	switch pool.backendName() {
+	case forgejoBackend:
+		backend = config.Forgejo
+	case gitLabBackend:
+		backend = config.GitLab
+	}
+	return specHash(struct {
+		Runner   any
+		Proxy    *Proxy
+		Labels   []string
+		Image    string
+		Snapshot *Snapshot
+	}{backend, config.Proxy, config.poolLabels(pool), config.poolImageName(pool), config.Snapshot})
+}
+
+// 同じタグで作り直したイメージを見分けるためのID。取得できなければ空
+func (config *Config) imageId(name string) string {
+	info, _, err := config.Cli.ImageInspectWithRaw(config.Ctx, name)
+	if err != nil {
+		return ""
+	}
+	return info.ID
+}
+
+func specHash(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// 動いている設定のプールはAPIからも変更されるのでロックを取って比べる
+func diffConfig(current, next *Config) ConfigDiff {
+	current.mu.Lock()
+	defer current.mu.Unlock()
+	diff := ConfigDiff{Rebuild: current.baseSpec() != next.baseSpec()}
+	for _, pool := range next.Pools {
+		old := current.findPoolLocked(pool.Name)
+		if old == nil {
+			diff.Added = append(diff.Added, pool.Name)
+			continue
+		}
+		if current.poolSpec(old) != next.poolSpec(pool) {
+			diff.Rolled = append(diff.Rolled, pool.Name)
+		}
+		if old.Limit != pool.Limit || old.Warm != pool.Warm {
+			diff.Scaled = append(diff.Scaled, pool.Name)
+		}
+	}
+	for _, pool := range current.Pools {
+		if next.findPool(pool.Name) == nil {
+			diff.Removed = append(diff.Removed, pool.Name)
+		}
+	}
+	return diff
+}
+
+// 設定ファイルを読み直して動いている設定に反映する。不正な設定の場合は今の設定のまま動かす
+func (config *Config) reload() error {
+	data, err := readConfig(config.ConfigPath)
+	if err != nil {
+		return err
+	}
+	next, err := makeConfig(data)
+	if err != nil {
+		return fmt.Errorf("Invalid config, keep running with the current one: %s", configFileError(config.ConfigPath, err))
+	}
+	next.Cli.Close()
+	// Dockerクライアントは作り直さないので接続先は再起動しないと変えられない
+	if next.ContainerHost != config.ContainerHost {
+		return fmt.Errorf("container_host can not be changed by reload, restart the controller to use %s", next.ContainerHost)
+	}
+	next.Cli = config.Cli
+	next.Ctx = config.Ctx
+
+	diff := diffConfig(config, next)
+	if diff.empty() {
+		log.Println("Config is not changed")
+		return nil
+	}
+	log.Printf("Reload config rebuild: %t added: %v removed: %v scaled: %v rolled: %v", diff.Rebuild, diff.Added, diff.Removed, diff.Scaled, diff.Rolled)
+
+	config.rollMu.Lock()
+	defer config.rollMu.Unlock()
+	// ビルドに失敗した場合は今の設定とイメージのまま動かす
+	if err := next.buildImages(diff.Rebuild); err != nil {
+		return fmt.Errorf("Can not build, keep running with the current config: %s", err)
+	}
+
+	config.mu.Lock()
+	removed := []*Pool{}
+	for _, name := range diff.Removed {
+		removed = append(removed, config.findPoolLocked(name))
+	}
+	for _, pool := range next.Pools {
+		if old := config.findPoolLocked(pool.Name); old != nil {
+			pool.Paused = old.Paused
+			pool.Failures, pool.BackoffUntil, pool.LastError = old.Failures, old.BackoffUntil, old.LastError
+		}
+	}
+	config.Runner = next.Runner
+	config.Forgejo = next.Forgejo
+	config.GitLab = next.GitLab
+	config.Limit = next.Limit
+	config.Labels = next.Labels
+	config.BaseImage = next.BaseImage
+	config.ImageHost = next.ImageHost
+	config.Version = next.Version
+	config.Arch = next.Arch
+	config.Dockerfile = next.Dockerfile
+	config.BuildContext = next.BuildContext
+	config.BuildArgs = next.BuildArgs
+	config.BaseDigest = next.BaseDigest
+	config.Layer = next.Layer
+	config.Offline = next.Offline
+	config.Proxy = next.Proxy
+	config.Snapshot = next.Snapshot
+	config.Logs = next.Logs
+	config.History = config.History.reopen(next.History)
+	config.HttpClient = next.HttpClient
+	config.Pools = next.Pools
+	config.mu.Unlock()
+
+	if err := config.prepareRunnerGroup(); err != nil {
+		return err
+	}
+
+	// 削除されたプールのコンテナは止める
+	for _, pool := range removed {
+		containers, err := config.listContainers(pool)
+		if err != nil {
+			return fmt.Errorf("Can not get containers list %s", err)
+		}
+		config.stopContainers(containers)
+	}
+	for _, pool := range config.poolList() {
+		if err := config.trimPool(pool); err != nil {
+			return err
+		}
+		if diff.Rebuild || slices.Contains(diff.Rolled, pool.Name) {
+			if err := config.rollPool(pool); err != nil {
+				return err
+			}
+		}
+	}
+	if ee := config.handleContainer(); ee != nil {
+		return *ee
+	}
+	return nil
+}
+
+// 古い設定や作り直す前のイメージで作ったコンテナを止める。止まったコンテナはdieイベントで新しい設定で作り直される
+func (config *Config) rollPool(pool *Pool) error {
+	containers, err := config.listContainers(pool)
+	if err != nil {
+		return fmt.Errorf("Can not get containers list %s", err)
+	}
+	spec := config.poolSpec(pool)
+	image := config.imageId(config.containerImage(pool))
+	stale := []types.Container{}
+	for _, c := range containers {
+		if c.Labels[specLabel] != spec || (image != "" && c.ImageID != image) {
+			stale = append(stale, c)
+		}
+	}
+	config.stopContainers(stale)
+	return nil
+}
+
+// 設定ファイルの更新日時を定期的に確認して変わったら通知する
+func watchConfig(path string, interval time.Duration, changed chan<- bool, stop <-chan bool) {
+	modTime := time.Time{}
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fi, err := os.Stat(path)
+			if err != nil || fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+			select {
+			case changed <- true:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
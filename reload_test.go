@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDiffConfig(t *testing.T) {
+	runner := &Runner{Owner: "owner", Auth: &Auth{AccessToken: "token"}}
+	current := &Config{Runner: runner, BaseImage: "Jammy", Version: "2.322.0", Pools: []*Pool{{Name: "go", Limit: 1}, {Name: "node", Limit: 1}}}
+	tests := []struct {
+		name  string
+		param *Config
+		want  ConfigDiff
+	}{
+		{
+			name:  "not changed",
+			param: &Config{Runner: runner, BaseImage: "Jammy", Version: "2.322.0", Pools: []*Pool{{Name: "go", Limit: 1}, {Name: "node", Limit: 1}}},
+			want:  ConfigDiff{},
+		},
+		{
+			name:  "scaled, added and removed",
+			param: &Config{Runner: runner, BaseImage: "Jammy", Version: "2.322.0", Pools: []*Pool{{Name: "go", Limit: 3}, {Name: "rust", Limit: 1}}},
+			want:  ConfigDiff{Added: []string{"rust"}, Removed: []string{"node"}, Scaled: []string{"go"}},
+		},
+		{
+			name:  "labels changed",
+			param: &Config{Runner: runner, BaseImage: "Jammy", Version: "2.322.0", Pools: []*Pool{{Name: "go", Limit: 1, Labels: []string{"go"}}, {Name: "node", Limit: 1}}},
+			want:  ConfigDiff{Rolled: []string{"go"}},
+		},
+		{
+			name:  "token changed",
+			param: &Config{Runner: &Runner{Owner: "owner", Auth: &Auth{AccessToken: "new_token"}}, BaseImage: "Jammy", Version: "2.322.0", Pools: []*Pool{{Name: "go", Limit: 1}, {Name: "node", Limit: 1}}},
+			want:  ConfigDiff{Rolled: []string{"go", "node"}},
+		},
+		{
+			name:  "base image changed",
+			param: &Config{Runner: runner, BaseImage: "Jammy", Version: "2.322.0", Layer: &Layer{Packages: []string{"git"}}, Pools: []*Pool{{Name: "go", Limit: 1}, {Name: "node", Limit: 1}}},
+			want:  ConfigDiff{Rebuild: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := diffConfig(current, tt.param)
+
+			if actual.Rebuild != tt.want.Rebuild || !slices.Equal(actual.Added, tt.want.Added) || !slices.Equal(actual.Removed, tt.want.Removed) || !slices.Equal(actual.Scaled, tt.want.Scaled) || !slices.Equal(actual.Rolled, tt.want.Rolled) {
+				t.Errorf("diffConfig() = \n%+v, want \n%+v", actual, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadContainerHost(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"container_host": "tcp://127.0.0.1:2375", "runner": {"owner": "tkmsaaaam", "auth": {"access_token": "example_access_token"}}}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{ContainerHost: "unix:///var/run/docker.sock", ConfigPath: path}
+
+	err := config.reload()
+
+	assert(t, "reload() error", err, fmt.Errorf("container_host can not be changed by reload, restart the controller to use tcp://127.0.0.1:2375"))
+	if config.ContainerHost != "unix:///var/run/docker.sock" {
+		t.Errorf("reload() ContainerHost = \n%v", config.ContainerHost)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed := make(chan bool, 1)
+	stop := make(chan bool)
+	defer close(stop)
+	go watchConfig(path, 10*time.Millisecond, changed, stop)
+
+	time.Sleep(30 * time.Millisecond)
+	if err := os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Errorf("watchConfig() did not notify the change")
+	}
+}
+
+func TestWatchConfigStop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 誰も受け取らなくても止められる
+	changed := make(chan bool)
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		watchConfig(path, 10*time.Millisecond, changed, stop)
+		close(done)
+	}()
+
+	if err := os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("watchConfig() did not stop")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// 設定ファイルのどこが不正かを示すエラー
+type ConfigError struct {
+	Path   string
+	Line   int
+	Column int
+	Msg    string
+	offset int64
+}
+
+func (e *ConfigError) Error() string {
+	// JSONに変換したYAMLやTOMLでは位置が意味を持たない
+	if e.Line == 0 {
+		return strings.TrimPrefix(e.Path+": ", ": ") + e.Msg
+	}
+	if e.Path == "" {
+		return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+	}
+	return fmt.Sprintf("%s at line %d, column %d: %s", e.Path, e.Line, e.Column, e.Msg)
+}
+
+// 未知のキーを許さずに設定ファイルを読み込む
+func decodeEnv(data []byte) (*Env, error) {
+	var env Env
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&env); err != nil {
+		// encoding/jsonのエラーには未知のキーの場所が含まれないので調べ直す
+		if strings.HasPrefix(err.Error(), "json: unknown field") {
+			if e := findUnknownField(data); e != nil {
+				return nil, e
+			}
+		}
+		return nil, toConfigError(data, dec.InputOffset(), err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, newConfigError(data, dec.InputOffset(), "", "unexpected data after the config")
+	}
+	return &env, nil
+}
+
+func findUnknownField(data []byte) *ConfigError {
+	var configError *ConfigError
+	if err := checkFields(json.NewDecoder(bytes.NewReader(data)), reflect.TypeOf(Env{}), ""); errors.As(err, &configError) {
+		configError.Line, configError.Column = position(data, configError.offset)
+		return configError
+	}
+	return nil
+}
+
+func toConfigError(data []byte, offset int64, err error) error {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxError):
+		// Offsetは不正な文字の次を指している
+		return newConfigError(data, max(syntaxError.Offset-1, 0), "", syntaxError.Error())
+	case errors.As(err, &typeError):
+		return newConfigError(data, typeError.Offset, typeError.Field, "expected "+typeError.Type.String()+" but got "+typeError.Value)
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return newConfigError(data, int64(len(data)), "", "unexpected end of JSON input")
+	}
+	return newConfigError(data, offset, "", strings.TrimPrefix(err.Error(), "json: "))
+}
+
+func newConfigError(data []byte, offset int64, path, msg string) *ConfigError {
+	line, column := position(data, offset)
+	return &ConfigError{Path: path, Line: line, Column: column, Msg: msg}
+}
+
+// バイト位置を1始まりの行と列に変換する
+func position(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// 型に存在しないキーがないかをJSONのパス付きで確認する
+func checkFields(dec *json.Decoder, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := token.(json.Delim)
+	if !ok {
+		return nil
+	}
+	switch delim {
+	case '{':
+		for dec.More() {
+			keyToken, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key := keyToken.(string)
+			offset := dec.InputOffset() - int64(len(strconv.Quote(key)))
+			var child reflect.Type
+			switch t.Kind() {
+			case reflect.Struct:
+				field, ok := findField(t, key)
+				if !ok {
+					return &ConfigError{Path: joinPath(path, key), Msg: "unknown field", offset: offset}
+				}
+				child = field.Type
+			case reflect.Map:
+				child = t.Elem()
+			default:
+				child = reflect.TypeOf((*any)(nil)).Elem()
+			}
+			if err := checkFields(dec, child, joinPath(path, key)); err != nil {
+				return err
+			}
+		}
+	case '[':
+		child := reflect.TypeOf((*any)(nil)).Elem()
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			child = t.Elem()
+		}
+		for i := 0; dec.More(); i++ {
+			if err := checkFields(dec, child, path+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+	}
+	// 閉じ括弧を読み飛ばす
+	_, err = dec.Token()
+	return err
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// encoding/jsonと同じく完全一致を優先して大文字小文字を区別せずにフィールドを探す
+func findField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var folded *reflect.StructField
+	for _, f := range jsonFields(t) {
+		name := jsonName(f)
+		if name == key {
+			return f, true
+		}
+		if folded == nil && strings.EqualFold(name, key) {
+			folded = &f
+		}
+	}
+	if folded != nil {
+		return *folded, true
+	}
+	return reflect.StructField{}, false
+}
+
+// 埋め込みの構造体を展開したJSONのフィールド
+func jsonFields(t reflect.Type) []reflect.StructField {
+	fields := []reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() || f.Tag.Get("json") == "-" {
+			continue
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && f.Tag.Get("json") == "" {
+			fields = append(fields, jsonFields(f.Type)...)
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func jsonName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// 設定の型から生成したJSON Schema
+func configSchema() map[string]any {
+	schema := typeSchema(reflect.TypeOf(Env{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "local-runner-controller config"
+	return schema
+}
+
+func typeSchema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]any{}
+		required := []string{}
+		for _, f := range jsonFields(t) {
+			properties[jsonName(f)] = typeSchema(f.Type)
+			if f.Tag.Get("schema") == "required" {
+				required = append(required, jsonName(f))
+			}
+		}
+		schema := map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]any{}
+}
+
+func configSchemaJson() ([]byte, error) {
+	data, err := json.MarshalIndent(configSchema(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestDecodeEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		param string
+		want  error
+	}{
+		{
+			name:  "valid",
+			param: `{"runner": {"owner": "tkmsaaaam", "auth": {"app": {"id": 1}}}, "pools": [{"name": "go", "packages": ["golang"]}]}`,
+			want:  nil,
+		},
+		{
+			name:  "syntax error",
+			param: "{\n  \"limit\": 1,\n}",
+			want:  fmt.Errorf("line 3, column 1: invalid character '}' looking for beginning of object key string"),
+		},
+		{
+			name:  "type error",
+			param: "{\n  \"runner\": {\"auth\": {\"app\": {\"id\": \"1\"}}}\n}",
+			want:  fmt.Errorf("runner.auth.app.id at line 2, column 40: expected int but got string"),
+		},
+		{
+			name:  "unknown field in pools",
+			param: `{"pools": [{"name": "go"}, {"name": "node", "package": ["nodejs"]}]}`,
+			want:  fmt.Errorf("pools[1].package at line 1, column 45: unknown field"),
+		},
+		{
+			name:  "unknown field in build_args is allowed",
+			param: `{"build_args": {"go_version": "1.23"}}`,
+			want:  nil,
+		},
+		{
+			name:  "data after config",
+			param: `{} {}`,
+			want:  fmt.Errorf("line 1, column 5: unexpected data after the config"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			_, actual := decodeEnv([]byte(tt.param))
+
+			assert(t, "decodeEnv() error", actual, tt.want)
+		})
+	}
+}
+
+func TestPosition(t *testing.T) {
+	data := []byte("{\n  \"a\": 1\n}")
+	tests := []struct {
+		name   string
+		param  int64
+		line   int
+		column int
+	}{
+		{name: "start", param: 0, line: 1, column: 1},
+		{name: "second line", param: 4, line: 2, column: 3},
+		{name: "over", param: 100, line: 3, column: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			line, column := position(data, tt.param)
+
+			if line != tt.line || column != tt.column {
+				t.Errorf("position() = %d, %d, want %d, %d", line, column, tt.line, tt.column)
+			}
+		})
+	}
+}
+
+func TestConfigSchemaIsUpToDate(t *testing.T) {
+	want, err := configSchemaJson()
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := os.ReadFile("config.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, want) {
+		t.Errorf("config.schema.json is outdated, run `go run . schema > config.schema.json`")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// 設定ファイルに直接書かずに参照で指定できる秘密情報の種類
+var secretSchemes = []string{"env", "file", "cmd", "keyring"}
+
+// env:NAME、file:/path、cmd:command、keyring:attr value ... を解決する。それ以外はそのままの値として扱う
+func resolveSecret(ref string) (string, error) {
+	scheme, value, ok := secretRef(ref)
+	if !ok {
+		return ref, nil
+	}
+	switch scheme {
+	case "env":
+		v, ok := os.LookupEnv(value)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", value)
+		}
+		return v, nil
+	case "file":
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return "", fmt.Errorf("Can not read %s", value)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case "cmd":
+		return runSecretCommand(exec.Command("sh", "-c", value), "cmd:"+value)
+	default:
+		// Secret Service(GNOME Keyringなど)から取り出す
+		args := append([]string{"lookup"}, strings.Fields(value)...)
+		if len(args)%2 != 1 || len(args) == 1 {
+			return "", fmt.Errorf("keyring:%s must be pairs of attribute and value", value)
+		}
+		return runSecretCommand(exec.Command("secret-tool", args...), "keyring:"+value)
+	}
+}
+
+func secretRef(ref string) (string, string, bool) {
+	scheme, value, ok := strings.Cut(ref, ":")
+	if !ok {
+		return "", "", false
+	}
+	for _, s := range secretSchemes {
+		if s == scheme {
+			return scheme, value, true
+		}
+	}
+	return "", "", false
+}
+
+// 出力は秘密情報なのでエラーには含めない
+func runSecretCommand(cmd *exec.Cmd, ref string) (string, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s failed %s", ref, err)
+	}
+	v := strings.TrimRight(string(out), "\r\n")
+	if v == "" {
+		return "", fmt.Errorf("%s returned nothing", ref)
+	}
+	return v, nil
+}
+
+// 解決した秘密情報。cmd:やkeyring:をリクエストごとに実行しないように、設定を読み直すか認証に失敗するまで使い回す
+type SecretCache struct {
+	mu    sync.Mutex
+	value string
+}
+
+func (c *SecretCache) get(ref, name string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.value != "" {
+		return c.value, nil
+	}
+	v, err := resolveSecret(ref)
+	if err != nil {
+		return "", fmt.Errorf("Can not resolve %s %s", name, err)
+	}
+	c.value = v
+	return v, nil
+}
+
+// ローテーションされた値を使うために次に使う時に解決し直す
+func (c *SecretCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value = ""
+}
+
+// PATを解決する
+func (auth *Auth) accessToken() (string, error) {
+	return auth.accessTokenCache.get(auth.AccessToken, "access_token")
+}
+
+// GitHub Appの秘密鍵を解決する。参照でなければkey_pathのファイルを読む
+func (auth *Auth) privateKey() ([]byte, error) {
+	if auth.keyFile() != "" {
+		data, err := os.ReadFile(auth.keyFile())
+		if err != nil {
+			return nil, fmt.Errorf("Can not read %s %s", auth.keyFile(), err)
+		}
+		return data, nil
+	}
+	key, err := resolveSecret(auth.App.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Can not resolve key_path %s", err)
+	}
+	return []byte(key + "\n"), nil
+}
+
+// ファイルで指定された秘密鍵のパス。参照で指定された場合は空
+func (auth *Auth) keyFile() string {
+	scheme, value, ok := secretRef(auth.App.KeyPath)
+	if !ok {
+		return auth.App.KeyPath
+	}
+	if scheme == "file" {
+		return value
+	}
+	return ""
+}
+
+// 設定を読み込んだ時に秘密情報を解決できるか確認する
+func (auth *Auth) resolve() error {
+	if auth.IsApp {
+		data, err := auth.privateKey()
+		if err != nil {
+			return err
+		}
+		_, err = parsePrivateKey(data)
+		return err
+	}
+	_, err := auth.accessToken()
+	return err
+}
+
+// 秘密情報をコンテナにマウントするために他のユーザーから読めないファイルに書き出す
+func writeSecretFile(path string, data []byte) (string, error) {
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", fmt.Errorf("Can not create file %s %s", path, err)
+	}
+	// 既にあるファイルはWriteFileでは権限が変わらない
+	if err := os.Chmod(path, 0600); err != nil {
+		return "", fmt.Errorf("Can not create file %s %s", path, err)
+	}
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("Can not get file path %s %s", path, err)
+	}
+	return abspath, nil
+}
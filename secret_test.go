@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "token.txt")
+	if err := os.WriteFile(file, []byte("file_token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LRC_TEST_TOKEN", "env_token")
+
+	type want struct {
+		value string
+		err   error
+	}
+	tests := []struct {
+		name  string
+		param string
+		want  want
+	}{
+		{
+			name:  "plain value",
+			param: "github_pat_xxxx",
+			want:  want{value: "github_pat_xxxx"},
+		},
+		{
+			name:  "unknown scheme is plain value",
+			param: "https://example.com",
+			want:  want{value: "https://example.com"},
+		},
+		{
+			name:  "env",
+			param: "env:LRC_TEST_TOKEN",
+			want:  want{value: "env_token"},
+		},
+		{
+			name:  "env is not set",
+			param: "env:LRC_TEST_NOT_SET",
+			want:  want{err: fmt.Errorf("environment variable LRC_TEST_NOT_SET is not set")},
+		},
+		{
+			name:  "file",
+			param: "file:" + file,
+			want:  want{value: "file_token"},
+		},
+		{
+			name:  "file is not present",
+			param: "file:" + filepath.Join(dir, "not_found"),
+			want:  want{err: fmt.Errorf("Can not read %s", filepath.Join(dir, "not_found"))},
+		},
+		{
+			name:  "cmd",
+			param: "cmd:echo cmd_token",
+			want:  want{value: "cmd_token"},
+		},
+		{
+			name:  "cmd failed does not show output",
+			param: "cmd:echo secret; exit 1",
+			want:  want{err: fmt.Errorf("cmd:echo secret; exit 1 failed exit status 1")},
+		},
+		{
+			name:  "keyring needs pairs",
+			param: "keyring:service",
+			want:  want{err: fmt.Errorf("keyring:service must be pairs of attribute and value")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual, err := resolveSecret(tt.param)
+
+			if actual != tt.want.value {
+				t.Errorf("resolveSecret() = \n%v, want \n%v", actual, tt.want.value)
+			}
+			assert(t, "resolveSecret() error", err, tt.want.err)
+		})
+	}
+}
+
+func TestAuthKeyFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		param string
+		want  string
+	}{
+		{
+			name:  "path",
+			param: "/path/to/key.pem",
+			want:  "/path/to/key.pem",
+		},
+		{
+			name:  "file ref",
+			param: "file:/path/to/key.pem",
+			want:  "/path/to/key.pem",
+		},
+		{
+			name:  "env ref",
+			param: "env:GH_APP_KEY",
+			want:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			auth := &Auth{IsApp: true, App: App{KeyPath: tt.param}}
+
+			if actual := auth.keyFile(); actual != tt.want {
+				t.Errorf("auth.keyFile() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pat.txt")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := writeSecretFile(path, []byte("new"))
+
+	assert(t, "writeSecretFile() error", err, nil)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("writeSecretFile() mode = \n%v, want \n%v", fi.Mode().Perm(), os.FileMode(0600))
+	}
+}
+
+func TestSecretCache(t *testing.T) {
+	t.Setenv("LOCAL_RUNNER_TEST_SECRET", "old")
+	cache := &SecretCache{}
+	if actual, err := cache.get("env:LOCAL_RUNNER_TEST_SECRET", "token"); actual != "old" || err != nil {
+		t.Fatalf("get() = %v, %v", actual, err)
+	}
+
+	// 解決し直すまでは前の値を使う
+	t.Setenv("LOCAL_RUNNER_TEST_SECRET", "new")
+	if actual, _ := cache.get("env:LOCAL_RUNNER_TEST_SECRET", "token"); actual != "old" {
+		t.Errorf("get() = \n%v, want \n%v", actual, "old")
+	}
+	cache.reset()
+	if actual, _ := cache.get("env:LOCAL_RUNNER_TEST_SECRET", "token"); actual != "new" {
+		t.Errorf("get() after reset = \n%v, want \n%v", actual, "new")
+	}
+
+	_, err := (&SecretCache{}).get("env:LOCAL_RUNNER_TEST_UNSET", "token")
+	assert(t, "get() error", err, fmt.Errorf("Can not resolve token environment variable LOCAL_RUNNER_TEST_UNSET is not set"))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// 登録以外の初期化を済ませたコンテナから作るイメージ
+type Snapshot struct {
+	Scripts []string `json:"scripts"`
+}
+
+// スナップショットを作るコンテナで動かすスクリプトを置く場所
+const primeScriptDir = "/actions-runner/prime.d"
+
+// ランナーの起動スクリプトから登録を除いたもの
+const primeCommand = `set -e
+if [ -e "` + containerCaBundle + `" ]; then
+  update-ca-certificates > /dev/null
+fi
+for f in ` + primeScriptDir + `/*; do
+  if [ -e "$f" ]; then
+    /bin/bash "$f"
+  fi
+done
+rm -rf ` + primeScriptDir
+
+func (snapshot *Snapshot) validate() error {
+	for _, s := range snapshot.Scripts {
+		if fi, err := os.Stat(s); err != nil || fi.IsDir() {
+			return fmt.Errorf("Can not find %s", s)
+		}
+	}
+	return nil
+}
+
+// 元のイメージとスクリプトのハッシュ。元のイメージを作り直すと名前が変わる
+func (snapshot *Snapshot) digest(imageId string) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(imageId))
+	for _, s := range snapshot.Scripts {
+		data, err := os.ReadFile(s)
+		if err != nil {
+			return "", fmt.Errorf("Can not read %s %s", s, err)
+		}
+		h.Write([]byte(s))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// プールのスナップショットのイメージ名
+func (config *Config) snapshotName(pool *Pool) (string, error) {
+	source := config.poolImageName(pool)
+	img, _, err := config.Cli.ImageInspectWithRaw(config.Ctx, source)
+	if err != nil {
+		return "", fmt.Errorf("Can not inspect %s %s", source, err)
+	}
+	digest, err := config.Snapshot.digest(img.ID)
+	if err != nil {
+		return "", err
+	}
+	return source + "-primed-" + digest[:12], nil
+}
+
+// コンテナを作るイメージ。スナップショットがあればそれを使う
+func (config *Config) containerImage(pool *Pool) string {
+	if pool.Snapshot != "" {
+		return pool.Snapshot
+	}
+	return config.poolImageName(pool)
+}
+
+// 各プールのスナップショットを必要に応じて作る。forceの場合は全て作り直す
+func (config *Config) primeImages(force bool) error {
+	if config.Snapshot == nil {
+		return nil
+	}
+	for _, pool := range config.poolList() {
+		name, err := config.snapshotName(pool)
+		if err != nil {
+			return err
+		}
+		build := force
+		if !build {
+			b, err := config.hasToBuild(name)
+			if err != nil {
+				return err
+			}
+			build = b
+		}
+		if build {
+			if err := config.primeImage(pool, name); err != nil {
+				return fmt.Errorf("pool %s %w", pool.Name, err)
+			}
+		}
+		config.mu.Lock()
+		pool.Snapshot = name
+		config.mu.Unlock()
+	}
+	return nil
+}
+
+// プールのイメージでコンテナを起動して初期化し、終了したコンテナをイメージにする
+func (config *Config) primeImage(pool *Pool, name string) error {
+	source := config.poolImageName(pool)
+	img, _, err := config.Cli.ImageInspectWithRaw(config.Ctx, source)
+	if err != nil {
+		return fmt.Errorf("Can not inspect %s %s", source, err)
+	}
+	env, binds, err := config.runtimeEnv()
+	if err != nil {
+		return err
+	}
+	log.Println("Prime", name)
+	resp, err := config.Cli.ContainerCreate(config.Ctx, &container.Config{
+		Image: source,
+		Env:   env,
+		Cmd:   []string{"/bin/bash", "-c", primeCommand},
+	}, &container.HostConfig{Binds: binds}, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("Can not create container %s", err)
+	}
+	defer func() {
+		if err := config.Cli.ContainerRemove(config.Ctx, resp.ID, container.RemoveOptions{Force: true}); err != nil {
+			log.Println("Can not remove container", resp.ID, err)
+		}
+	}()
+
+	scripts, err := config.Snapshot.scriptsTar()
+	if err != nil {
+		return err
+	}
+	if err := config.Cli.CopyToContainer(config.Ctx, resp.ID, "/", scripts, container.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("Can not copy scripts %s", err)
+	}
+
+	waitChan, errChan := config.Cli.ContainerWait(config.Ctx, resp.ID, container.WaitConditionNextExit)
+	if err := config.Cli.ContainerStart(config.Ctx, resp.ID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("Error starting container: %s", err)
+	}
+	select {
+	case res := <-waitChan:
+		if res.StatusCode != 0 {
+			return fmt.Errorf("Can not prime %s exit status: %d", name, res.StatusCode)
+		}
+	case err := <-errChan:
+		return fmt.Errorf("Can not wait container %s", err)
+	}
+
+	// 起動コマンドと環境変数は元のイメージに戻す。プロキシの設定をイメージに残さない
+	_, err = config.Cli.ContainerCommit(config.Ctx, resp.ID, container.CommitOptions{
+		Reference: name,
+		Config: &container.Config{
+			Cmd:        img.Config.Cmd,
+			Entrypoint: img.Config.Entrypoint,
+			Env:        img.Config.Env,
+			WorkingDir: img.Config.WorkingDir,
+			Labels:     map[string]string{parentImageLabel: source, poolLabel: pool.Name},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Can not commit %s %s", name, err)
+	}
+	return nil
+}
+
+func (snapshot *Snapshot) scriptsTar() (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i, s := range snapshot.Scripts {
+		data, err := os.ReadFile(s)
+		if err != nil {
+			return nil, fmt.Errorf("Can not read %s %s", s, err)
+		}
+		name := fmt.Sprintf("%s/%02d-%s", primeScriptDir[1:], i, filepath.Base(s))
+		if err := addTarFile(tw, name, data, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close tar writer: %w", err)
+	}
+	return &buf, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		param *Snapshot
+		want  error
+	}{
+		{
+			name:  "no scripts",
+			param: &Snapshot{},
+			want:  nil,
+		},
+		{
+			name:  "script",
+			param: &Snapshot{Scripts: []string{"./dockerfiles/start.sh"}},
+			want:  nil,
+		},
+		{
+			name:  "not found",
+			param: &Snapshot{Scripts: []string{"./not_found.sh"}},
+			want:  fmt.Errorf("Can not find ./not_found.sh"),
+		},
+		{
+			name:  "directory",
+			param: &Snapshot{Scripts: []string{"./dockerfiles"}},
+			want:  fmt.Errorf("Can not find ./dockerfiles"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := tt.param.validate()
+
+			assert(t, "snapshot.validate()", actual, tt.want)
+		})
+	}
+}
+
+func TestSnapshotDigest(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "toolcache.sh")
+	if err := os.WriteFile(script, []byte("echo go"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &Snapshot{Scripts: []string{script}}
+
+	first, err := snapshot.digest("sha256:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, _ := snapshot.digest("sha256:1")
+	rebuilt, _ := snapshot.digest("sha256:2")
+	if err := os.WriteFile(script, []byte("echo node"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed, _ := snapshot.digest("sha256:1")
+
+	if first != same {
+		t.Errorf("digest() = \n%v, want \n%v", same, first)
+	}
+	if first == rebuilt {
+		t.Errorf("digest() does not change when the image is rebuilt")
+	}
+	if first == changed {
+		t.Errorf("digest() does not change when the script is changed")
+	}
+}
+
+func TestSnapshotScriptsTar(t *testing.T) {
+	snapshot := &Snapshot{Scripts: []string{"./dockerfiles/start.sh", "./dockerfiles/gitlab-start.sh"}}
+
+	buf, err := snapshot.scriptsTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	tr := tar.NewReader(buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Mode != 0755 {
+			t.Errorf("scriptsTar() %s mode = %o", h.Name, h.Mode)
+		}
+		names = append(names, h.Name)
+	}
+	if fmt.Sprint(names) != "[actions-runner/prime.d/00-start.sh actions-runner/prime.d/01-gitlab-start.sh]" {
+		t.Errorf("scriptsTar() = \n%v", names)
+	}
+}
+
+func TestContainerImage(t *testing.T) {
+	config := &Config{BaseImage: "noble", Version: "2.322.0"}
+	tests := []struct {
+		name  string
+		param *Pool
+		want  string
+	}{
+		{
+			name:  "without snapshot",
+			param: &Pool{Name: "default"},
+			want:  "local-runner:noble-2.322.0",
+		},
+		{
+			name:  "with snapshot",
+			param: &Pool{Name: "default", Snapshot: "local-runner:noble-2.322.0-primed-0123456789ab"},
+			want:  "local-runner:noble-2.322.0-primed-0123456789ab",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := config.containerImage(tt.param)
+
+			if actual != tt.want {
+				t.Errorf("containerImage() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}
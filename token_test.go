@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		param []byte
+		want  error
+	}{
+		{
+			name:  "pkcs1",
+			param: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+			want:  nil,
+		},
+		{
+			name:  "pkcs8",
+			param: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+			want:  nil,
+		},
+		{
+			name:  "not pem",
+			param: []byte("private key"),
+			want:  fmt.Errorf("private key is not PEM"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual, actualError := parsePrivateKey(tt.param)
+
+			if actualError == nil && !actual.Equal(key) {
+				t.Errorf("parsePrivateKey() = \n%v, want \n%v", actual, key)
+			}
+			assert(t, "parsePrivateKey() error", actualError, tt.want)
+		})
+	}
+}
+
+func TestAppJwt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+
+	actual, err := appJwt(12345, key, now)
+	if err != nil {
+		t.Fatalf("appJwt() error = %v", err)
+	}
+
+	parts := strings.Split(actual, ".")
+	if len(parts) != 3 {
+		t.Fatalf("appJwt() = %v, want 3 parts", actual)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature); err != nil {
+		t.Errorf("appJwt() signature is invalid %v", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		Iat int64  `json:"iat"`
+		Exp int64  `json:"exp"`
+		Iss string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Iss != "12345" || claims.Iat != 1699999940 || claims.Exp != 1700000540 {
+		t.Errorf("appJwt() claims = %v", claims)
+	}
+}
+
+func TestInstallationToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/app/installations/1/access_tokens" || r.Header.Get("Authorization") != "Bearer jwt" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"token": "ghs_xxxx", "expires_at": "2024-01-01T01:00:00Z"}`)
+	}))
+	defer server.Close()
+
+	token, expiresAt, err := installationToken(http.DefaultClient, server.URL, "jwt", 1)
+	if err != nil {
+		t.Fatalf("installationToken() error = %v", err)
+	}
+	if token != "ghs_xxxx" {
+		t.Errorf("installationToken() = \n%v, want \n%v", token, "ghs_xxxx")
+	}
+	if !expiresAt.Equal(time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)) {
+		t.Errorf("installationToken() expiresAt = \n%v", expiresAt)
+	}
+
+	_, _, err = installationToken(http.DefaultClient, server.URL, "invalid", 1)
+	assert(t, "installationToken() error", err, fmt.Errorf("can not get installation token status: 401"))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 期限が切れるこの時間前にトークンを更新する
+const tokenRefreshMargin = 5 * time.Minute
+
+// トークンの取得に失敗した時に再試行する回数と最初の待ち時間
+const tokenRetries = 3
+const tokenBackoff = time.Second
+
+// トークンを取得するAPIが返したステータス
+type StatusError int
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("status: %d", int(e))
+}
+
+// 期限付きのトークンを期限が近づくまで使い回す。複数のゴルーチンから呼べる
+type TokenSource struct {
+	Fetch func() (string, time.Time, error)
+	Now   func() time.Time
+	Sleep func(time.Duration)
+
+	mu        sync.Mutex
+	value     string
+	expiresAt time.Time
+}
+
+func (s *TokenSource) token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	if s.value != "" && now().Add(tokenRefreshMargin).Before(s.expiresAt) {
+		return s.value, nil
+	}
+
+	sleep := time.Sleep
+	if s.Sleep != nil {
+		sleep = s.Sleep
+	}
+	backoff := tokenBackoff
+	var err error
+	for i := 0; ; i++ {
+		token, expiresAt, e := s.Fetch()
+		if e == nil {
+			s.value, s.expiresAt = token, expiresAt
+			return token, nil
+		}
+		err = e
+		if i == tokenRetries || !retryable(err) {
+			break
+		}
+		log.Println("Can not get token, retry in", backoff, err)
+		sleep(backoff)
+		backoff *= 2
+	}
+	// 更新できなくてもまだ期限内なら今のトークンを使う
+	if s.value != "" && now().Before(s.expiresAt) {
+		log.Println("Can not refresh token, use the current one", err)
+		return s.value, nil
+	}
+	return "", err
+}
+
+// 通信の失敗とサーバーのエラーだけ再試行する。認証の失敗は何度やっても変わらない
+func retryable(err error) bool {
+	var status StatusError
+	if !errors.As(err, &status) {
+		return true
+	}
+	return int(status) == http.StatusTooManyRequests || int(status) >= 500
+}
+
+// インストールごとのトークン
+type TokenCache struct {
+	mu      sync.Mutex
+	sources map[string]*TokenSource
+}
+
+var installationTokens = &TokenCache{}
+
+func (c *TokenCache) source(apiUrl string, installationId int, fetch func() (string, time.Time, error)) *TokenSource {
+	key := apiUrl + "/" + strconv.Itoa(installationId)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sources == nil {
+		c.sources = map[string]*TokenSource{}
+	}
+	s, ok := c.sources[key]
+	if !ok {
+		s = &TokenSource{}
+		c.sources[key] = s
+	}
+	// 設定を読み直した場合は新しい鍵で取得する
+	s.mu.Lock()
+	s.Fetch = fetch
+	s.mu.Unlock()
+	return s
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenSource(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	type fetched struct {
+		token string
+		err   error
+	}
+	tests := []struct {
+		name    string
+		value   string
+		expires time.Time
+		fetch   []fetched
+		want    string
+		calls   int
+		wantErr error
+	}{
+		{
+			name:  "first call",
+			fetch: []fetched{{token: "new"}},
+			want:  "new",
+			calls: 1,
+		},
+		{
+			name:    "cached",
+			value:   "old",
+			expires: now.Add(time.Hour),
+			want:    "old",
+			calls:   0,
+		},
+		{
+			name:    "near expiry",
+			value:   "old",
+			expires: now.Add(time.Minute),
+			fetch:   []fetched{{token: "new"}},
+			want:    "new",
+			calls:   1,
+		},
+		{
+			name:  "retry server error",
+			fetch: []fetched{{err: StatusError(502)}, {err: fmt.Errorf("connection refused")}, {token: "new"}},
+			want:  "new",
+			calls: 3,
+		},
+		{
+			name:    "not retry unauthorized",
+			fetch:   []fetched{{err: fmt.Errorf("can not get installation token %w", StatusError(401))}},
+			calls:   1,
+			wantErr: fmt.Errorf("can not get installation token status: 401"),
+		},
+		{
+			name:    "give up",
+			fetch:   []fetched{{err: StatusError(500)}, {err: StatusError(500)}, {err: StatusError(500)}, {err: StatusError(500)}},
+			calls:   4,
+			wantErr: fmt.Errorf("status: 500"),
+		},
+		{
+			name:    "keep current token on failure",
+			value:   "old",
+			expires: now.Add(time.Minute),
+			fetch:   []fetched{{err: StatusError(403)}},
+			want:    "old",
+			calls:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			calls := 0
+			sleeps := []time.Duration{}
+			s := &TokenSource{
+				Fetch: func() (string, time.Time, error) {
+					f := tt.fetch[calls]
+					calls++
+					return f.token, now.Add(time.Hour), f.err
+				},
+				Now:       func() time.Time { return now },
+				Sleep:     func(d time.Duration) { sleeps = append(sleeps, d) },
+				value:     tt.value,
+				expiresAt: tt.expires,
+			}
+
+			actual, err := s.token()
+
+			if actual != tt.want {
+				t.Errorf("token() = \n%v, want \n%v", actual, tt.want)
+			}
+			if calls != tt.calls {
+				t.Errorf("token() calls = \n%v, want \n%v", calls, tt.calls)
+			}
+			for i, d := range sleeps {
+				if d != tokenBackoff<<i {
+					t.Errorf("token() sleeps = \n%v", sleeps)
+				}
+			}
+			assert(t, "token() error", err, tt.wantErr)
+		})
+	}
+}
+
+func TestTokenSourceConcurrent(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	cache := &TokenCache{}
+	fetch := func() (string, time.Time, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return "token", time.Now().Add(time.Hour), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := cache.source("https://api.github.com", 1, fetch).token(); token != "token" || err != nil {
+				t.Errorf("token() = %v, %v", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("token() calls = \n%v, want \n%v", calls, 1)
+	}
+	if cache.source("https://api.github.com", 2, fetch) == cache.source("https://api.github.com", 1, fetch) {
+		t.Errorf("source() is shared between installations")
+	}
+}
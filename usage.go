@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// コンテナが使ったリソース。CPUとI/Oは起動してからの合計
+type Usage struct {
+	CpuSeconds float64 `json:"cpu_seconds"`
+	PeakMemory uint64  `json:"peak_memory"`
+	NetworkRx  uint64  `json:"network_rx"`
+	NetworkTx  uint64  `json:"network_tx"`
+	BlockRead  uint64  `json:"block_read"`
+	BlockWrite uint64  `json:"block_write"`
+}
+
+// 統計を取り終えるのを待つ時間
+const usageFlushTimeout = 5 * time.Second
+
+// 統計を取っている途中のコンテナとその結果
+type UsageSamplers struct {
+	mu     sync.Mutex
+	usages map[string]*Usage
+	done   map[string]chan bool
+}
+
+var usageSamplers = &UsageSamplers{}
+
+func (s *UsageSamplers) start(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done == nil {
+		s.usages = map[string]*Usage{}
+		s.done = map[string]chan bool{}
+	}
+	s.usages[id] = &Usage{}
+	s.done[id] = make(chan bool)
+}
+
+func (s *UsageSamplers) update(id string, stats *container.StatsResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if usage, ok := s.usages[id]; ok {
+		usage.add(stats)
+	}
+}
+
+func (s *UsageSamplers) finish(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if done, ok := s.done[id]; ok {
+		close(done)
+		delete(s.done, id)
+	}
+}
+
+// 記録せずに削除したコンテナの統計を捨てる
+func (s *UsageSamplers) drop(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if done, ok := s.done[id]; ok {
+		close(done)
+		delete(s.done, id)
+	}
+	delete(s.usages, id)
+}
+
+// 統計を取り終えるのを待って結果を取り出す
+func (s *UsageSamplers) take(id string, timeout time.Duration) *Usage {
+	s.mu.Lock()
+	done, ok := s.done[id]
+	s.mu.Unlock()
+	if ok {
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			log.Println("Timed out sampling stats of", id)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := s.usages[id]
+	delete(s.usages, id)
+	return usage
+}
+
+// 統計の1回分を反映する。累積値は最新の値で上書きし、メモリは最大値を残す
+func (usage *Usage) add(stats *container.StatsResponse) {
+	if cpu := float64(stats.CPUStats.CPUUsage.TotalUsage) / float64(time.Second); cpu > usage.CpuSeconds {
+		usage.CpuSeconds = cpu
+	}
+	usage.PeakMemory = max(usage.PeakMemory, stats.MemoryStats.Usage, stats.MemoryStats.MaxUsage)
+	var rx, tx uint64
+	for _, n := range stats.Networks {
+		rx += n.RxBytes
+		tx += n.TxBytes
+	}
+	usage.NetworkRx, usage.NetworkTx = max(usage.NetworkRx, rx), max(usage.NetworkTx, tx)
+	var read, write uint64
+	for _, e := range stats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(e.Op) {
+		case "read":
+			read += e.Value
+		case "write":
+			write += e.Value
+		}
+	}
+	usage.BlockRead, usage.BlockWrite = max(usage.BlockRead, read), max(usage.BlockWrite, write)
+}
+
+// 起動したコンテナの統計を終了するまで取る。ジョブの履歴を残す場合だけ
+func (config *Config) sampleUsage(id string) {
+	if config.History == nil {
+		return
+	}
+	usageSamplers.start(id)
+	go func() {
+		defer usageSamplers.finish(id)
+		res, err := config.Cli.ContainerStats(config.Ctx, id, true)
+		if err != nil {
+			log.Println("Can not get stats", id, err)
+			return
+		}
+		defer res.Body.Close()
+		decoder := json.NewDecoder(res.Body)
+		for {
+			var stats container.StatsResponse
+			if err := decoder.Decode(&stats); err != nil {
+				if err != io.EOF {
+					log.Println("Can not read stats", id, err)
+				}
+				return
+			}
+			usageSamplers.update(id, &stats)
+		}
+	}()
+}
+
+// リポジトリとワークフローごとの合計
+type UsageReport struct {
+	Repository string
+	Workflow   string
+	Jobs       int
+	Duration   time.Duration
+	Usage      Usage
+}
+
+func makeUsageReport(records []JobRecord) []UsageReport {
+	reports := map[string]*UsageReport{}
+	for _, r := range records {
+		key := r.Repository + "\x00" + r.Workflow
+		report, ok := reports[key]
+		if !ok {
+			report = &UsageReport{Repository: r.Repository, Workflow: r.Workflow}
+			reports[key] = report
+		}
+		report.Jobs++
+		if !r.StartedAt.IsZero() && r.FinishedAt.After(r.StartedAt) {
+			report.Duration += r.FinishedAt.Sub(r.StartedAt)
+		}
+		if r.Usage == nil {
+			continue
+		}
+		report.Usage.CpuSeconds += r.Usage.CpuSeconds
+		report.Usage.PeakMemory = max(report.Usage.PeakMemory, r.Usage.PeakMemory)
+		report.Usage.NetworkRx += r.Usage.NetworkRx
+		report.Usage.NetworkTx += r.Usage.NetworkTx
+		report.Usage.BlockRead += r.Usage.BlockRead
+		report.Usage.BlockWrite += r.Usage.BlockWrite
+	}
+	list := []UsageReport{}
+	for _, r := range reports {
+		list = append(list, *r)
+	}
+	// CPUを多く使ったものから並べる
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Usage.CpuSeconds != list[j].Usage.CpuSeconds {
+			return list[i].Usage.CpuSeconds > list[j].Usage.CpuSeconds
+		}
+		return list[i].Repository+list[i].Workflow < list[j].Repository+list[j].Workflow
+	})
+	return list
+}
+
+func printUsageReport(w io.Writer, reports []UsageReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REPOSITORY\tWORKFLOW\tJOBS\tDURATION\tCPU\tPEAK MEMORY\tNET RX/TX\tBLOCK R/W")
+	for _, r := range reports {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%.1fs\t%s\t%s/%s\t%s/%s\n", r.Repository, r.Workflow, r.Jobs, r.Duration.Round(time.Second),
+			r.Usage.CpuSeconds, formatBytes(r.Usage.PeakMemory), formatBytes(r.Usage.NetworkRx), formatBytes(r.Usage.NetworkTx), formatBytes(r.Usage.BlockRead), formatBytes(r.Usage.BlockWrite))
+	}
+	return tw.Flush()
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestUsageAdd(t *testing.T) {
+	sample := func(cpu, memory, rx, read uint64) *container.StatsResponse {
+		stats := &container.StatsResponse{}
+		stats.CPUStats.CPUUsage.TotalUsage = cpu
+		stats.MemoryStats.Usage = memory
+		stats.Networks = map[string]container.NetworkStats{"eth0": {RxBytes: rx, TxBytes: rx / 2}, "eth1": {RxBytes: 1}}
+		stats.BlkioStats.IoServiceBytesRecursive = []container.BlkioStatEntry{{Op: "read", Value: read}, {Op: "Write", Value: read * 2}, {Op: "total", Value: read * 3}}
+		return stats
+	}
+	usage := &Usage{}
+	usage.add(sample(uint64(time.Second), 300, 100, 10))
+	usage.add(sample(uint64(3*time.Second/2), 200, 400, 20))
+	// コンテナが止まる直前の値は0になることがある
+	usage.add(&container.StatsResponse{})
+
+	want := Usage{CpuSeconds: 1.5, PeakMemory: 300, NetworkRx: 401, NetworkTx: 200, BlockRead: 20, BlockWrite: 40}
+	if *usage != want {
+		t.Errorf("add() = \n%v, want \n%v", *usage, want)
+	}
+}
+
+func TestUsageSamplers(t *testing.T) {
+	samplers := &UsageSamplers{}
+	if usage := samplers.take("unknown", time.Millisecond); usage != nil {
+		t.Errorf("take() unknown = \n%v", usage)
+	}
+
+	samplers.start("id")
+	stats := &container.StatsResponse{}
+	stats.MemoryStats.Usage = 100
+	samplers.update("id", stats)
+	go samplers.finish("id")
+	usage := samplers.take("id", time.Second)
+	if usage == nil || usage.PeakMemory != 100 {
+		t.Errorf("take() = \n%v", usage)
+	}
+	if usage := samplers.take("id", time.Millisecond); usage != nil {
+		t.Errorf("take() twice = \n%v", usage)
+	}
+
+	samplers.start("removed")
+	samplers.drop("removed")
+	samplers.finish("removed")
+	if len(samplers.usages) != 0 || len(samplers.done) != 0 {
+		t.Errorf("drop() left = \n%v %v", samplers.usages, samplers.done)
+	}
+}
+
+func TestMakeUsageReport(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	records := []JobRecord{
+		{Repository: "o/a", Workflow: "ci", StartedAt: start, FinishedAt: start.Add(time.Minute), Usage: &Usage{CpuSeconds: 10, PeakMemory: 100, NetworkRx: 1}},
+		{Repository: "o/a", Workflow: "ci", StartedAt: start, FinishedAt: start.Add(2 * time.Minute), Usage: &Usage{CpuSeconds: 20, PeakMemory: 50, NetworkRx: 2}},
+		{Repository: "o/a", Workflow: "release", FinishedAt: start, Usage: &Usage{CpuSeconds: 40}},
+		{Repository: "o/b", Workflow: "ci", StartedAt: start, FinishedAt: start.Add(time.Minute)},
+	}
+
+	reports := makeUsageReport(records)
+
+	want := []UsageReport{
+		{Repository: "o/a", Workflow: "release", Jobs: 1, Usage: Usage{CpuSeconds: 40}},
+		{Repository: "o/a", Workflow: "ci", Jobs: 2, Duration: 3 * time.Minute, Usage: Usage{CpuSeconds: 30, PeakMemory: 100, NetworkRx: 3}},
+		{Repository: "o/b", Workflow: "ci", Jobs: 1, Duration: time.Minute},
+	}
+	if len(reports) != len(want) {
+		t.Fatalf("makeUsageReport() = \n%v, want \n%v", reports, want)
+	}
+	for i := range want {
+		if reports[i] != want[i] {
+			t.Errorf("makeUsageReport()[%d] = \n%v, want \n%v", i, reports[i], want[i])
+		}
+	}
+
+	var out bytes.Buffer
+	if err := printUsageReport(&out, reports); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "30.0s") || !strings.Contains(out.String(), "100B") {
+		t.Errorf("printUsageReport() = \n%s", out.String())
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		name  string
+		param uint64
+		want  string
+	}{
+		{name: "bytes", param: 1023, want: "1023B"},
+		{name: "kibibytes", param: 1536, want: "1.5KiB"},
+		{name: "gibibytes", param: 2 << 30, want: "2.0GiB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := formatBytes(tt.param)
+
+			if actual != tt.want {
+				t.Errorf("formatBytes() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// 待機しているコンテナに登録の設定を渡すディレクトリ
+const warmDir = "./warm"
+const warmMount = "/mnt/local-runner"
+
+// 待機するコンテナとして作ったことを示すラベル
+const warmLabel = "local-runner.warm"
+
+// 起動スクリプトはこのファイルが書き出されるまで待つ
+const warmEnvFile = "runner.env"
+
+// 登録した時のラベル。コンテナのラベルは起動後に変えられないのでファイルに残す
+const warmLabelsFile = "labels.json"
+
+// 起動して登録の設定を待っているコンテナか
+func warmIdle(c types.Container) bool {
+	if c.Labels[warmLabel] == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(warmDir, containerName(c), warmEnvFile))
+	return err != nil
+}
+
+// 登録の設定を待っているコンテナ。古い設定で作ったものは削除する
+func (config *Config) warmContainers(pool *Pool) ([]types.Container, error) {
+	list, err := config.Cli.ContainerList(config.Ctx, container.ListOptions{Filters: filters.NewArgs(
+		filters.KeyValuePair{Key: "label", Value: poolLabel + "=" + pool.Name},
+		filters.KeyValuePair{Key: "label", Value: warmLabel},
+	)})
+	if err != nil {
+		return nil, err
+	}
+	spec := config.poolSpec(pool)
+	image := config.imageId(config.containerImage(pool))
+	warm := []types.Container{}
+	for _, c := range list {
+		if !warmIdle(c) {
+			continue
+		}
+		if c.Labels[specLabel] != spec || c.Image != config.containerImage(pool) || (image != "" && c.ImageID != image) {
+			config.removeWarmContainer(c)
+			continue
+		}
+		warm = append(warm, c)
+	}
+	return warm, nil
+}
+
+// 登録はせずにコンテナを起動しておく。起動スクリプトは証明書の更新まで済ませて登録の設定を待つ
+func (config *Config) createWarmContainer(pool *Pool, backend Backend) error {
+	name := backend.runnerName(pool)
+	dir := filepath.Join(warmDir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Can not create %s %s", dir, err)
+	}
+	abspath, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("Can not get file path %s %s", dir, err)
+	}
+	id, err := config.newContainer(pool, name, &ContainerSpec{
+		Binds:  []string{abspath + ":" + warmMount + ":ro"},
+		Labels: map[string]string{warmLabel: "true"},
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := config.Cli.ContainerStart(config.Ctx, id, container.StartOptions{}); err != nil {
+		if err := config.Cli.ContainerRemove(config.Ctx, id, container.RemoveOptions{Force: true}); err != nil {
+			log.Println("Can not remove container", id, err)
+		}
+		os.RemoveAll(dir)
+		return fmt.Errorf("Error starting container: %s", err)
+	}
+	return nil
+}
+
+// ランナーを登録して待機しているコンテナに設定を渡す。登録したIDのラベルは付けられないのでファイルに残す
+func (config *Config) startWarmContainer(pool *Pool, backend Backend, c types.Container) error {
+	name := containerName(c)
+	spec, err := backend.containerSpec(config, pool, name)
+	if err != nil {
+		return &SpecError{Err: err}
+	}
+	if err := writeWarmFiles(filepath.Join(warmDir, name), spec); err != nil {
+		return err
+	}
+	log.Println("Handed off registration to warm container", name)
+	config.captureLogs(pool, c.ID, name)
+	config.sampleUsage(c.ID)
+	return nil
+}
+
+// 作成だけしたコンテナの数をプールの設定に合わせる
+func (config *Config) fillWarmPool(pool *Pool, backend Backend, warm []types.Container) {
+	for i := len(warm); i < pool.Warm; i++ {
+		if err := config.createWarmContainer(pool, backend); err != nil {
+			log.Println("Error creating warm container: ", err)
+			return
+		}
+	}
+	for i := pool.Warm; i < len(warm); i++ {
+		config.removeWarmContainer(warm[i])
+	}
+}
+
+func (config *Config) removeWarmContainer(c types.Container) {
+	log.Println("Remove warm container", c.ID)
+	if err := config.Cli.ContainerRemove(config.Ctx, c.ID, container.RemoveOptions{Force: true}); err != nil {
+		log.Println("Can not remove container", c.ID, err)
+	}
+	usageSamplers.drop(c.ID)
+	removeWarmFiles(containerName(c))
+}
+
+func removeWarmFiles(name string) {
+	if name == "" {
+		return
+	}
+	os.RemoveAll(filepath.Join(warmDir, name))
+}
+
+func containerName(c types.Container) string {
+	if len(c.Names) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// ラベルがなくても登録を解除できるように、登録した時のラベルを合わせる
+func runnerLabels(name string, labels map[string]string) map[string]string {
+	if name == "" {
+		return labels
+	}
+	data, err := os.ReadFile(filepath.Join(warmDir, name, warmLabelsFile))
+	if err != nil {
+		return labels
+	}
+	var saved map[string]string
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Println("Can not read labels of", name, err)
+		return labels
+	}
+	merged := map[string]string{}
+	for k, v := range saved {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return merged
+}
+
+// コンテナの起動スクリプトが読む環境変数とマウントの代わりのファイルを書き出す。
+// 起動スクリプトは環境変数のファイルができたら読み始めるので最後に置き換える
+func writeWarmFiles(dir string, spec *ContainerSpec) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Can not create %s %s", dir, err)
+	}
+	labels, err := json.Marshal(spec.Labels)
+	if err != nil {
+		return err
+	}
+	if _, err := writeSecretFile(filepath.Join(dir, warmLabelsFile), labels); err != nil {
+		return err
+	}
+	for _, bind := range spec.Binds {
+		parts := strings.Split(bind, ":")
+		if len(parts) < 2 {
+			return fmt.Errorf("Invalid bind %s", bind)
+		}
+		data, err := os.ReadFile(parts[0])
+		if err != nil {
+			return fmt.Errorf("Can not read %s %s", parts[0], err)
+		}
+		dest := filepath.Join(dir, "files", parts[1])
+		if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+			return fmt.Errorf("Can not create %s %s", filepath.Dir(dest), err)
+		}
+		if _, err := writeSecretFile(dest, data); err != nil {
+			return err
+		}
+	}
+	var env strings.Builder
+	for _, e := range spec.Env {
+		k, v, _ := strings.Cut(e, "=")
+		env.WriteString(k + "=" + shellQuote(v) + "\n")
+	}
+	tmp := filepath.Join(dir, warmEnvFile+".tmp")
+	if _, err := writeSecretFile(tmp, []byte(env.String())); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, warmEnvFile)); err != nil {
+		return fmt.Errorf("Can not create file %s %s", warmEnvFile, err)
+	}
+	return nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestWriteWarmFiles(t *testing.T) {
+	dir := t.TempDir()
+	token := filepath.Join(dir, "token.txt")
+	if err := os.WriteFile(token, []byte("registration-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	spec := &ContainerSpec{
+		Env:   []string{"JIT_CONFIG=abc=", "LABELS=it's"},
+		Binds: []string{token + ":/mnt/registration-token.txt:ro"},
+	}
+	warm := filepath.Join(dir, "warm")
+
+	if err := writeWarmFiles(warm, spec); err != nil {
+		t.Fatalf("writeWarmFiles() error = %v", err)
+	}
+
+	env, err := os.ReadFile(filepath.Join(warm, "runner.env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(env) != "JIT_CONFIG='abc='\nLABELS='it'\\''s'\n" {
+		t.Errorf("runner.env = \n%v", string(env))
+	}
+	data, err := os.ReadFile(filepath.Join(warm, "files", "mnt", "registration-token.txt"))
+	if err != nil || string(data) != "registration-token" {
+		t.Errorf("registration-token.txt = \n%v %v", string(data), err)
+	}
+	if fi, err := os.Stat(filepath.Join(warm, "runner.env")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("runner.env mode = \n%v %v", fi.Mode(), err)
+	}
+	if _, err := os.Stat(filepath.Join(warm, "runner.env.tmp")); err == nil {
+		t.Errorf("runner.env.tmp is left")
+	}
+}
+
+func TestWarmIdleAndRunnerLabels(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	c := types.Container{Names: []string{"/local-runner-go-1"}, Labels: map[string]string{warmLabel: "true", poolLabel: "go"}}
+	if !warmIdle(c) {
+		t.Errorf("warmIdle() before handoff = false")
+	}
+	if warmIdle(types.Container{Names: c.Names, Labels: map[string]string{poolLabel: "go"}}) {
+		t.Errorf("warmIdle() not warm = true")
+	}
+	if labels := runnerLabels("local-runner-go-1", c.Labels); labels[runnerIdLabel] != "" {
+		t.Errorf("runnerLabels() before handoff = \n%v", labels)
+	}
+
+	spec := &ContainerSpec{Env: []string{"JIT_CONFIG=abc"}, Labels: map[string]string{runnerIdLabel: "42"}}
+	if err := writeWarmFiles(filepath.Join(warmDir, "local-runner-go-1"), spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if warmIdle(c) {
+		t.Errorf("warmIdle() after handoff = true")
+	}
+	labels := runnerLabels("local-runner-go-1", c.Labels)
+	if labels[runnerIdLabel] != "42" || labels[poolLabel] != "go" {
+		t.Errorf("runnerLabels() after handoff = \n%v", labels)
+	}
+}
+
+func TestContainerName(t *testing.T) {
+	tests := []struct {
+		name  string
+		param types.Container
+		want  string
+	}{
+		{
+			name:  "name",
+			param: types.Container{Names: []string{"/local-runner-go-1"}},
+			want:  "local-runner-go-1",
+		},
+		{
+			name:  "no name",
+			param: types.Container{},
+			want:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Helper()
+
+			actual := containerName(tt.param)
+
+			if actual != tt.want {
+				t.Errorf("containerName() = \n%v, want \n%v", actual, tt.want)
+			}
+		})
+	}
+}